@@ -1,22 +1,31 @@
 package compress
 
-import "strings"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 // A tiny copy is better than a small dependency.
-func negotiateAcceptHeader(in []string, offers []string, bestOffer string) string {
+func negotiateAcceptHeader(in []string, offers []string, bestOffer string, maxSpecs int) string {
 	if bestOffer == "" {
 		bestOffer = IDENTITY
 	}
 
+	if offer, ok := negotiateSimpleAcceptHeader(in, offers, maxSpecs); ok {
+		if offer == "" {
+			return bestOffer
+		}
+
+		return offer
+	}
+
 	bestQ := -1.0
-	specs := parseAccept(in)
+	specs := parseAccept(in, maxSpecs)
 	for _, offer := range offers {
-		for _, spec := range specs {
-			if spec.Q > bestQ &&
-				(spec.Value == "*" || spec.Value == offer) {
-				bestQ = spec.Q
-				bestOffer = offer
-			}
+		if q := offerQuality(specs, offer); q > bestQ {
+			bestQ = q
+			bestOffer = offer
 		}
 	}
 	if bestQ == 0 {
@@ -25,45 +34,256 @@ func negotiateAcceptHeader(in []string, offers []string, bestOffer string) strin
 	return bestOffer
 }
 
+// negotiateSimpleAcceptHeader is the allocation-free fast path of negotiateAcceptHeader
+// for header values without quality values and wildcards, e.g. "gzip, deflate, br",
+// which is what almost every client sends.
+// All specs are of the same quality there, so the first offer found wins.
+// It reports false when the header values are not that simple
+// and they should be parsed by the full parser instead.
+func negotiateSimpleAcceptHeader(in []string, offers []string, maxSpecs int) (string, bool) {
+	for _, s := range in {
+		if strings.IndexByte(s, ';') != -1 || strings.IndexByte(s, '*') != -1 {
+			return "", false
+		}
+	}
+
+	for _, offer := range offers {
+		remaining := maxSpecs
+		for _, s := range in {
+			var found bool
+			if found, remaining = hasAcceptToken(s, offer, remaining, maxSpecs > 0); found {
+				return offer, true
+			}
+		}
+	}
+
+	return "", true
+}
+
+// hasAcceptToken reports whether the "token" is listed on the Accept* header value "s"
+// which contains no parameters, among its first "remaining" specs, if "limited".
+// It follows the parseAccept rules and it returns the specs left to look up,
+// see `WithMaxAcceptSpecs`.
+func hasAcceptToken(s string, token string, remaining int, limited bool) (bool, int) {
+	for {
+		s = skipSpace(s)
+		if s != "" && s[0] != ',' {
+			if limited && remaining <= 0 {
+				return false, remaining
+			}
+			remaining--
+
+			var value string
+			value, s = expectTokenSlash(s)
+			s = skipSpace(s)
+			if value != "" && endOfSpec(s) && strings.EqualFold(value, token) {
+				return true, remaining
+			}
+		}
+
+		if s = nextSpec(s); s == "" {
+			return false, remaining
+		}
+	}
+}
+
+// acceptedOffers returns the "offers" which are acceptable by the "in" header values,
+// sorted by their quality, the best first. Offers of equal quality keep their order.
+func acceptedOffers(in []string, offers []string, maxSpecs int) []string {
+	specs := parseAccept(in, maxSpecs)
+
+	var (
+		accepted []string
+		qs       []float64
+	)
+
+	for _, offer := range offers {
+		q := offerQuality(specs, offer)
+		if q <= 0 {
+			continue
+		}
+
+		// Insertion sort, offers are always a few.
+		i := len(accepted)
+		for i > 0 && qs[i-1] < q {
+			i--
+		}
+
+		accepted = append(accepted, "")
+		qs = append(qs, 0)
+		copy(accepted[i+1:], accepted[i:])
+		copy(qs[i+1:], qs[i:])
+		accepted[i] = offer
+		qs[i] = q
+	}
+
+	return accepted
+}
+
+// identityAcceptable reports whether the "identity" encoding is acceptable
+// by the "in" header values. It is, unless it is explicitly refused through
+// "identity;q=0" or through "*;q=0" without an "identity" spec.
+func identityAcceptable(in []string, maxSpecs int) bool {
+	return offerQuality(parseAccept(in, maxSpecs), IDENTITY) != 0
+}
+
+// offerQuality returns the quality of the "offer" among the "specs".
+// An offer listed explicitly gets the quality of its own spec,
+// even if there is a wildcard ("*") spec, so "gzip;q=0, *" refuses gzip only.
+// Otherwise it gets the quality of the wildcard spec, if any.
+// It returns -1 if the offer is neither listed nor matched by a wildcard.
+func offerQuality(specs []acceptSpec, offer string) float64 {
+	q, wildcardQ := -1.0, -1.0
+	for _, spec := range specs {
+		switch {
+		case strings.EqualFold(spec.Value, offer):
+			if spec.Q > q {
+				q = spec.Q
+			}
+		case spec.Value == "*":
+			if spec.Q > wildcardQ {
+				wildcardQ = spec.Q
+			}
+		}
+	}
+
+	if q == -1 {
+		return wildcardQ
+	}
+
+	return q
+}
+
 // acceptSpec describes an Accept* header.
 type acceptSpec struct {
 	Value string
 	Q     float64
 }
 
-// parseAccept parses Accept* headers.
-func parseAccept(in []string) (specs []acceptSpec) {
-loop:
+// parseAccept parses Accept* headers, up to "maxSpecs" specs,
+// a non-positive "maxSpecs" parses all of them. See `WithMaxAcceptSpecs`.
+// Invalid specs are skipped, up to the next comma, and they count
+// towards the "maxSpecs" too. Empty list elements are ignored.
+func parseAccept(in []string, maxSpecs int) (specs []acceptSpec) {
+	n := 0
 	for _, s := range in {
 		for {
-			var spec acceptSpec
-			spec.Value, s = expectTokenSlash(s)
-			if spec.Value == "" {
-				continue loop
-			}
-			spec.Q = 1.0
 			s = skipSpace(s)
-			if strings.HasPrefix(s, ";") {
-				s = skipSpace(s[1:])
-				if !strings.HasPrefix(s, "q=") {
-					continue loop
+			if s != "" && s[0] != ',' {
+				if maxSpecs > 0 && n >= maxSpecs {
+					return
 				}
-				spec.Q, s = expectQuality(s[2:])
-				if spec.Q < 0.0 {
-					continue loop
+				n++
+
+				if spec, ok := expectSpec(s); ok {
+					specs = append(specs, spec)
 				}
 			}
-			specs = append(specs, spec)
-			s = skipSpace(s)
-			if !strings.HasPrefix(s, ",") {
-				continue loop
+
+			if s = nextSpec(s); s == "" {
+				break
 			}
-			s = skipSpace(s[1:])
 		}
 	}
 	return
 }
 
+// expectSpec parses the spec at the start of "s": token [ ";" weight ],
+// which should be followed by the end of the value or a comma.
+func expectSpec(s string) (spec acceptSpec, ok bool) {
+	spec.Value, s = expectTokenSlash(s)
+	if spec.Value == "" {
+		return spec, false
+	}
+
+	spec.Q = 1.0
+	s = skipSpace(s)
+	if strings.HasPrefix(s, ";") {
+		if spec.Q, s = expectWeight(skipSpace(s[1:])); spec.Q < 0.0 {
+			return spec, false
+		}
+		s = skipSpace(s)
+	}
+
+	return spec, endOfSpec(s)
+}
+
+// endOfSpec reports whether the "s" which follows a spec ends it properly.
+func endOfSpec(s string) bool {
+	return s == "" || s[0] == ','
+}
+
+// nextSpec returns the "s" after its first comma, the list elements separator,
+// or empty if there is none. Neither tokens nor weights contain commas,
+// so it skips the rest of the current spec, even if it is invalid.
+func nextSpec(s string) string {
+	i := strings.IndexByte(s, ',')
+	if i == -1 {
+		return ""
+	}
+
+	return s[i+1:]
+}
+
+// ErrMalformedAcceptEncoding is returned from `ValidateAcceptEncoding`
+// when an Accept-Encoding header value is syntactically invalid.
+// Check that error with `errors.Is`.
+var ErrMalformedAcceptEncoding = errors.New("compress: malformed accept-encoding")
+
+// ValidateAcceptEncoding reports whether the Accept-Encoding header "values"
+// follow the RFC 7231 syntax: a comma-separated list of content-codings,
+// each one with an optional ";q=" weight of 0 to 1 with up to three decimals.
+// It returns a descriptive `ErrMalformedAcceptEncoding` error for the first invalid value.
+//
+// The negotiation itself is lenient and skips invalid specs,
+// see `WithStrictAcceptEncoding` to reject malformed headers instead.
+func ValidateAcceptEncoding(values []string) error {
+	for _, s := range values {
+		if err := validateAcceptEncoding(s); err != nil {
+			return fmt.Errorf("%w: %q: %s", ErrMalformedAcceptEncoding, s, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func validateAcceptEncoding(s string) error {
+	for {
+		s = skipSpace(s)
+		if s == "" {
+			return nil
+		}
+		if s[0] == ',' { // empty list elements are allowed.
+			s = s[1:]
+			continue
+		}
+
+		start := s
+		var value string
+		value, s = expectTokenSlash(s)
+		if value == "" || strings.IndexByte(value, '/') != -1 {
+			return fmt.Errorf("expected a content-coding at %q", start)
+		}
+
+		s = skipSpace(s)
+		if strings.HasPrefix(s, ";") {
+			var q float64
+			if q, s = expectWeight(skipSpace(s[1:])); q < 0.0 {
+				return fmt.Errorf("expected a valid q= weight for %q", value)
+			}
+			s = skipSpace(s)
+		}
+
+		if s == "" {
+			return nil
+		}
+		if s[0] != ',' {
+			return fmt.Errorf("unexpected %q after %q", s, value)
+		}
+		s = s[1:]
+	}
+}
+
 func skipSpace(s string) (rest string) {
 	i := 0
 	for ; i < len(s); i++ {
@@ -85,6 +305,24 @@ func expectTokenSlash(s string) (token, rest string) {
 	return s[:i], s[i:]
 }
 
+// expectWeight parses a weight parameter: "q=" qvalue, its name is case-insensitive.
+// It is the single qvalue grammar of both the negotiation and `ValidateAcceptEncoding`.
+// It returns a negative "q" if the weight is invalid.
+func expectWeight(s string) (q float64, rest string) {
+	if len(s) < 2 || (s[0] != 'q' && s[0] != 'Q') || s[1] != '=' {
+		return -1, ""
+	}
+
+	q, s = expectQuality(s[2:])
+	if q < 0 || !endOfQuality(s) {
+		return -1, ""
+	}
+
+	return q, s
+}
+
+// expectQuality parses a qvalue: ( "0" [ "." 0*3DIGIT ] ) / ( "1" [ "." 0*3("0") ] ).
+// It returns a negative "q" if the value is invalid.
 func expectQuality(s string) (q float64, rest string) {
 	switch {
 	case len(s) == 0:
@@ -109,10 +347,25 @@ func expectQuality(s string) (q float64, rest string) {
 		if b < '0' || b > '9' {
 			break
 		}
+		// RFC 7231 allows up to three decimals,
+		// longer values are invalid, they cannot overflow either.
+		if i == 3 {
+			return -1, ""
+		}
 		n = n*10 + int(b) - '0'
 		d *= 10
 	}
-	return q + float64(n)/float64(d), s[i:]
+	q += float64(n) / float64(d)
+	if q > 1 {
+		return -1, ""
+	}
+	return q, s[i:]
+}
+
+// endOfQuality reports whether the "s" which follows a quality value
+// ends it properly, e.g. it is not the ".2" of "0.1.2".
+func endOfQuality(s string) bool {
+	return s == "" || s[0] == ',' || s[0] == ';' || octetTypes[s[0]]&isSpace != 0
 }
 
 // Octet types from RFC 2616.
@@ -0,0 +1,309 @@
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// browserAcceptEncoding is the Accept-Encoding header of the common browsers.
+var browserAcceptEncoding = []string{"gzip, deflate, br"}
+
+func TestNegotiateSimpleAcceptHeaderAllocs(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		negotiateAcceptHeader(browserAcceptEncoding, DefaultOffers, IDENTITY, defaultMaxAcceptSpecs)
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations but got %v", allocs)
+	}
+}
+
+func TestNegotiateSimpleAcceptHeader(t *testing.T) {
+	tests := []struct {
+		in       []string
+		offers   []string
+		expected string
+		ok       bool
+	}{
+		{[]string{"gzip, deflate, br"}, []string{BROTLI, GZIP}, BROTLI, true},
+		{[]string{"deflate", "GZIP"}, []string{GZIP, DEFLATE}, GZIP, true},
+		{[]string{"zstd"}, []string{GZIP}, "", true},
+		{[]string{"gzip;q=0.5, br"}, []string{GZIP}, "", false},
+		{[]string{"*"}, []string{GZIP}, "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := negotiateSimpleAcceptHeader(tt.in, tt.offers, defaultMaxAcceptSpecs)
+		if got != tt.expected || ok != tt.ok {
+			t.Errorf("%q: expected (%q, %v) but got (%q, %v)", tt.in, tt.expected, tt.ok, got, ok)
+		}
+	}
+}
+
+func BenchmarkNegotiateAcceptHeader(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		negotiateAcceptHeader(browserAcceptEncoding, DefaultOffers, IDENTITY, defaultMaxAcceptSpecs)
+	}
+}
+
+// BenchmarkNegotiateAcceptHeaderFullParser measures the negotiation
+// without the fast path, as it was before it.
+func BenchmarkNegotiateAcceptHeaderFullParser(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		specs := parseAccept(browserAcceptEncoding, defaultMaxAcceptSpecs)
+		bestQ := -1.0
+		for _, offer := range DefaultOffers {
+			if q := offerQuality(specs, offer); q > bestQ {
+				bestQ = q
+			}
+		}
+	}
+}
+
+func TestValidateAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"", true},
+		{"gzip, deflate, br", true},
+		{"gzip;q=1.0, identity; q=0.5, *;q=0", true},
+		{"gzip;Q=0.001", true},
+		{"gzip , , br", true},
+		{"gzip;q=", false},
+		{";;;", false},
+		{"q=2", false},
+		{"gzip;q=2", false},
+		{"gzip;q=1.001", false},
+		{"gzip;q=0.0001", false},
+		{"gzip;q=0.1.2", false},
+		{"gzip;level=1", false},
+		{"text/html", false},
+		{"gzip br", false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateAcceptEncoding([]string{tt.value})
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("%q: expected valid=%v but got error: %v", tt.value, tt.valid, err)
+			continue
+		}
+
+		if err != nil && !errors.Is(err, ErrMalformedAcceptEncoding) {
+			t.Errorf("%q: expected ErrMalformedAcceptEncoding but got %v", tt.value, err)
+		}
+	}
+}
+
+func TestNegotiateAcceptHeaderWildcard(t *testing.T) {
+	tests := []struct {
+		header   string
+		offers   []string
+		expected string
+	}{
+		{"*;q=0.5, br;q=1", DefaultOffers, BROTLI},
+		{"*;q=0.5, br;q=1", []string{GZIP, DEFLATE}, GZIP},
+		{"gzip;q=0, *", []string{GZIP, BROTLI}, BROTLI},
+		{"gzip;q=0, *", DefaultOffers, DEFLATE},
+		{"gzip;q=0, *", []string{GZIP}, ""},
+		{"*", DefaultOffers, GZIP},
+		{"*", []string{BROTLI, GZIP}, BROTLI},
+		{"*;q=0", DefaultOffers, ""},
+		{"*;q=0, gzip;q=0.1", DefaultOffers, GZIP},
+	}
+
+	for _, tt := range tests {
+		if got := negotiateAcceptHeader([]string{tt.header}, tt.offers, IDENTITY, defaultMaxAcceptSpecs); got != tt.expected {
+			t.Errorf("%q %v: expected %q but got %q", tt.header, tt.offers, tt.expected, got)
+		}
+	}
+}
+
+func TestMaxAcceptSpecs(t *testing.T) {
+	specs := make([]string, 10000)
+	for i := range specs {
+		specs[i] = fmt.Sprintf("x-%d;q=0.5", i)
+	}
+	header := strings.Join(specs, ", ")
+
+	if got := len(parseAccept([]string{header}, defaultMaxAcceptSpecs)); got != defaultMaxAcceptSpecs {
+		t.Fatalf("expected %d parsed specs but got %d", defaultMaxAcceptSpecs, got)
+	}
+	if got := len(parseAccept([]string{header}, 0)); got != len(specs) {
+		t.Fatalf("expected all the %d specs to be parsed without a limit but got %d", len(specs), got)
+	}
+
+	tests := []struct {
+		header   string
+		opts     []Option
+		encoding string
+	}{
+		// The first specs are negotiated.
+		{"gzip, " + header, nil, GZIP},
+		{"gzip;q=0.1, " + header, nil, GZIP},
+		{"gzip, " + strings.ReplaceAll(header, ";q=0.5", ""), nil, GZIP},
+		// The rest are ignored.
+		{header + ", gzip", nil, ""},
+		{strings.ReplaceAll(header, ";q=0.5", "") + ", gzip", nil, ""},
+		{header + ", gzip", []Option{WithMaxAcceptSpecs(20000)}, GZIP},
+		{header + ", gzip", []Option{WithMaxAcceptSpecs(0)}, GZIP},
+		{"x-1, x-2, gzip", []Option{WithMaxAcceptSpecs(2)}, ""},
+	}
+
+	for i, tt := range tests {
+		h := WriteHandler(http.HandlerFunc(writeTestBody), tt.opts...)
+		rec := serve(h, newTestRequest(tt.header))
+		if got := rec.Header().Get(ContentEncodingHeaderKey); got != tt.encoding {
+			t.Fatalf("[%d] expected encoding %q but got %q", i, tt.encoding, got)
+		}
+	}
+}
+
+func FuzzParseAccept(f *testing.F) {
+	for _, seed := range []string{
+		// Browsers and common clients.
+		"gzip, deflate, br",
+		"gzip, deflate, br, zstd",
+		"gzip, deflate",
+		"gzip;q=1.0, identity; q=0.5, *;q=0",
+		"br;q=1.0, gzip;q=0.8, *;q=0.1",
+		"identity",
+		"*",
+		"",
+		// Malformed.
+		"gzip;q=",
+		"gzip;q=0.1.2, br;q=0.1",
+		"gzip;q=0.0001, br;q=0.5",
+		"gzip;q=99999999999999999999999",
+		"gzip;q=1.5",
+		"gzip;level=1, br",
+		";;;",
+		",,,",
+		"gzip,,br",
+		"q=2",
+		"gzip br",
+		"\x00\xff, gzip",
+		"gzip;q=0.5;q=0.1",
+		"gzip ; q = 0.5",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		in := []string{s}
+
+		specs := parseAccept(in, 0)
+		for _, spec := range specs {
+			if spec.Value == "" {
+				t.Fatalf("%q: parsed an empty spec", s)
+			}
+			if spec.Q < 0 || spec.Q > 1 {
+				t.Fatalf("%q: parsed an out of range weight %v of %q", s, spec.Q, spec.Value)
+			}
+		}
+
+		if n := len(parseAccept(in, 2)); n > 2 {
+			t.Fatalf("%q: expected up to 2 specs but got %d", s, n)
+		}
+
+		// The fast path and the full parser negotiate the same.
+		offers := []string{GZIP, DEFLATE, BROTLI}
+		if offer, ok := negotiateSimpleAcceptHeader(in, offers, 0); ok {
+			expected := ""
+			for _, candidate := range offers {
+				if q := offerQuality(specs, candidate); q > 0 {
+					expected = candidate
+					break
+				}
+			}
+			if offer != expected {
+				t.Fatalf("%q: the fast path negotiated %q but the parser %q", s, offer, expected)
+			}
+		}
+
+		// A valid header is parsed entirely.
+		if ValidateAcceptEncoding(in) == nil {
+			elements := 0
+			for _, element := range strings.Split(s, ",") {
+				if strings.Trim(element, " \t\r\n") != "" {
+					elements++
+				}
+			}
+			if len(specs) != elements {
+				t.Fatalf("%q: expected %d specs of a valid header but got %d", s, elements, len(specs))
+			}
+		}
+
+		_ = negotiateAcceptHeader(in, offers, IDENTITY, defaultMaxAcceptSpecs)
+		_ = acceptedOffers(in, offers, defaultMaxAcceptSpecs)
+	})
+}
+
+func TestExpectQuality(t *testing.T) {
+	tests := []struct {
+		value string
+		q     float64
+		rest  string
+	}{
+		{"0", 0, ""},
+		{"1", 1, ""},
+		{"0.", 0, ""},
+		{"1.", 1, ""},
+		{"0.5", 0.5, ""},
+		{"0.01", 0.01, ""},
+		{"0.001", 0.001, ""},
+		{"0.999", 0.999, ""},
+		{"1.0", 1, ""},
+		{"1.000", 1, ""},
+		{"0.5, br", 0.5, ", br"},
+		{"0.1.2", 0.1, ".2"},
+		{"0.0001", -1, ""},
+		{"1.001", -1, ""},
+		{"1.5", -1, ""},
+		{"2", -1, ""},
+		{".5", -1, ""},
+		{"", -1, ""},
+	}
+
+	for _, tt := range tests {
+		if q, rest := expectQuality(tt.value); q != tt.q || rest != tt.rest {
+			t.Errorf("%q: expected (%v, %q) but got (%v, %q)", tt.value, tt.q, tt.rest, q, rest)
+		}
+	}
+}
+
+func TestNegotiateAcceptHeaderInvalidSpecs(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		// Invalid specs are skipped, the rest are still negotiated.
+		{"gzip;q=0.0001, br;q=0.5", BROTLI},
+		{"gzip;q=0.1.2, br;q=0.1", BROTLI},
+		{"gzip;q=2, br;q=0.1", BROTLI},
+		{"gzip;level=1, br", BROTLI},
+		{"gzip br, deflate", DEFLATE},
+		{";;;, gzip;q=0.5", GZIP},
+		{"gzip;q=, ,br;q=0.001", BROTLI},
+		{"gzip;Q=0.5, br;q=0.1", GZIP},
+		// The q-values are compared on their three decimals.
+		{"gzip;q=0.001, br;q=0.01", BROTLI},
+		{"gzip;q=1.0, br;q=0.999", GZIP},
+		{"gzip;q=0.1.2", IDENTITY},
+	}
+
+	for _, tt := range tests {
+		if got := negotiateAcceptHeader([]string{tt.header}, []string{GZIP, DEFLATE, BROTLI}, IDENTITY, defaultMaxAcceptSpecs); got != tt.expected {
+			t.Errorf("%q: expected %q but got %q", tt.header, tt.expected, got)
+		}
+	}
+
+	// Through the handler.
+	h := WriteHandler(http.HandlerFunc(writeTestBody))
+	expectResponse(t, serve(h, newTestRequest("gzip;q=0.0001, br;q=0.5")), BROTLI, testBody)
+	expectResponse(t, serve(h, newTestRequest("gzip;q=0.1.2, br;q=0.1")), BROTLI, testBody)
+}
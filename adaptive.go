@@ -0,0 +1,249 @@
+package compress
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// AdaptiveWindow is the sampling window of the adaptive writer:
+// the amount of uncompressed bytes written between two evaluations
+// of the observed compression ratio. See `NewAdaptiveWriter`.
+const AdaptiveWindow = 64 * 1024
+
+// The adaptive writer's compression ratio (compressed/uncompressed) thresholds.
+const (
+	// adaptivePoorRatio and above means the data is (mostly) incompressible.
+	adaptivePoorRatio = 0.9
+	// adaptiveGreatRatio and below means the data compress well.
+	adaptiveGreatRatio = 0.4
+)
+
+// adaptiveLevels are the levels the adaptive writer moves through,
+// from the fastest to the best compression.
+var adaptiveLevels = [...]int{HuffmanOnly, flate.BestSpeed, 5, flate.BestCompression}
+
+// adaptiveStartLevel is the index of the adaptiveLevels to start with.
+const adaptiveStartLevel = 1
+
+// adaptiveSampleSize is the amount of data, at the start of a window,
+// which is compressed apart to estimate the window's ratio
+// when the caller flushed the writer in the middle of it.
+const adaptiveSampleSize = 16 * 1024
+
+type adaptiveWriter struct {
+	dst        *countWriter
+	fw         *flate.Writer
+	levelIndex int
+	// Uncompressed bytes written since the last evaluation.
+	written int64
+	// True when the caller flushed the writer since the last evaluation.
+	flushed bool
+	// The start of the window's data and its compressor, see `sampleRatio`.
+	sample         []byte
+	estimator      *flate.Writer
+	estimatorLevel int
+
+	gzip            bool
+	wroteGzipHeader bool
+	digest          uint32
+	size            uint32
+}
+
+var _ Writer = (*adaptiveWriter)(nil)
+
+// NewAdaptiveWriter returns a Writer of "w" based on the given "encoding"
+// which adapts its compression level to the data written.
+// Only the "gzip" and "deflate" encodings are supported.
+//
+// It starts at the best speed level and, at every flush boundary
+// after an `AdaptiveWindow` of data was written, it evaluates the
+// compressed/uncompressed bytes ratio of that window:
+// if the ratio is poor (the data are incompressible) it drops to a faster level,
+// down to `HuffmanOnly`, and if the ratio is great it moves to a higher level,
+// up to the best compression. The writer flushes by itself
+// when a window is filled, so the level adapts even if `Flush` is never called.
+// When `Flush` is called in the middle of a window, e.g. on every write
+// of a `ResponseWriter` with AutoFlush, the output is dominated by the flushed
+// blocks' overhead, so the ratio is estimated by compressing the start of the window
+// apart instead.
+//
+// The level is changed by finishing the current deflate block with a sync flush
+// and continuing the same stream with a compressor of the new level,
+// so the output is a single, standard, gzip or deflate stream.
+func NewAdaptiveWriter(w io.Writer, encoding string) (Writer, error) {
+	if encoding != GZIP && encoding != DEFLATE {
+		return nil, ErrNotSupportedCompression
+	}
+
+	aw := &adaptiveWriter{gzip: encoding == GZIP}
+	aw.Reset(w)
+	return aw, nil
+}
+
+// Level returns the current compression level.
+func (w *adaptiveWriter) Level() int {
+	return adaptiveLevels[w.levelIndex]
+}
+
+func (w *adaptiveWriter) Write(p []byte) (int, error) {
+	if err := w.writeGzipHeader(); err != nil {
+		return 0, err
+	}
+
+	n, err := w.fw.Write(p)
+	if free := adaptiveSampleSize - len(w.sample); free > 0 {
+		if free > n {
+			free = n
+		}
+		w.sample = append(w.sample, p[:free]...)
+	}
+	if w.gzip {
+		w.digest = crc32.Update(w.digest, crc32.IEEETable, p[:n])
+		w.size += uint32(n)
+	}
+	w.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if w.written >= AdaptiveWindow {
+		err = w.Flush()
+	}
+
+	return n, err
+}
+
+// Underlying returns the *flate.Writer of the current compression level.
+// It is replaced when the level changes.
+func (w *adaptiveWriter) Underlying() interface{} {
+	return w.fw
+}
+
+// Flush flushes any pending data to the underlying writer
+// and adapts the compression level if a sampling window is completed.
+func (w *adaptiveWriter) Flush() error {
+	if err := w.writeGzipHeader(); err != nil {
+		return err
+	}
+
+	if err := w.fw.Flush(); err != nil {
+		return err
+	}
+
+	if w.written < AdaptiveWindow {
+		w.flushed = w.flushed || w.written > 0
+		return nil
+	}
+
+	ratio := float64(w.dst.n) / float64(w.written)
+	if w.flushed {
+		ratio = w.sampleRatio()
+	}
+	w.written = 0
+	w.dst.n = 0
+	w.flushed = false
+	w.sample = w.sample[:0]
+
+	levelIndex := w.levelIndex
+	switch {
+	case ratio >= adaptivePoorRatio && levelIndex > 0:
+		levelIndex--
+	case ratio <= adaptiveGreatRatio && levelIndex < len(adaptiveLevels)-1:
+		levelIndex++
+	}
+
+	if levelIndex == w.levelIndex {
+		return nil
+	}
+
+	// The stream is byte-aligned after the sync flush,
+	// the new compressor continues it with independent blocks.
+	fw, err := flate.NewWriter(w.dst, adaptiveLevels[levelIndex])
+	if err != nil {
+		return err
+	}
+
+	w.fw = fw
+	w.levelIndex = levelIndex
+	return nil
+}
+
+// sampleRatio returns the compressed/uncompressed bytes ratio of the window's sample
+// at the current level, as if the window was not flushed by the caller.
+func (w *adaptiveWriter) sampleRatio() float64 {
+	if len(w.sample) == 0 {
+		return 1
+	}
+
+	level := adaptiveLevels[w.levelIndex]
+	counter := &countWriter{Writer: io.Discard}
+	if w.estimator == nil || w.estimatorLevel != level {
+		w.estimator, _ = flate.NewWriter(counter, level)
+		w.estimatorLevel = level
+	} else {
+		w.estimator.Reset(counter)
+	}
+
+	w.estimator.Write(w.sample)
+	w.estimator.Close()
+	return float64(counter.n) / float64(len(w.sample))
+}
+
+func (w *adaptiveWriter) Close() error {
+	if err := w.writeGzipHeader(); err != nil {
+		return err
+	}
+
+	if err := w.fw.Close(); err != nil {
+		return err
+	}
+
+	if !w.gzip {
+		return nil
+	}
+
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], w.digest)
+	binary.LittleEndian.PutUint32(trailer[4:], w.size)
+	_, err := w.dst.Write(trailer[:])
+	return err
+}
+
+func (w *adaptiveWriter) Reset(dst io.Writer) {
+	w.dst = &countWriter{Writer: dst}
+	w.levelIndex = adaptiveStartLevel
+	w.fw, _ = flate.NewWriter(w.dst, adaptiveLevels[w.levelIndex])
+	w.written = 0
+	w.flushed = false
+	w.sample = w.sample[:0]
+	w.wroteGzipHeader = false
+	w.digest = 0
+	w.size = 0
+}
+
+func (w *adaptiveWriter) writeGzipHeader() error {
+	if !w.gzip || w.wroteGzipHeader {
+		return nil
+	}
+	w.wroteGzipHeader = true
+
+	// RFC 1952: ID1, ID2, CM (deflate), FLG, MTIME (4), XFL, OS (unknown).
+	header := [10]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+	_, err := w.dst.Write(header[:])
+	return err
+}
+
+// countWriter counts the bytes written to the underlying Writer.
+type countWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,121 @@
+package compress
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdaptiveWriter(t *testing.T) {
+	random := make([]byte, 4*AdaptiveWindow)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := []byte(strings.Repeat(testBody, 1+len(random)/len(testBody)))
+
+	tests := []struct {
+		name   string
+		data   []byte
+		expect func(level int) bool
+	}{
+		{"random data downshift", random, func(level int) bool { return level < adaptiveLevels[adaptiveStartLevel] }},
+		{"text upshift", text, func(level int) bool { return level > adaptiveLevels[adaptiveStartLevel] }},
+	}
+
+	for _, encoding := range []string{GZIP, DEFLATE} {
+		for _, tt := range tests {
+			var buf bytes.Buffer
+			w, err := NewAdaptiveWriter(&buf, encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Written in small pieces, as a streaming response does.
+			for p := tt.data; len(p) > 0; {
+				n := 4096
+				if n > len(p) {
+					n = len(p)
+				}
+				if _, err = w.Write(p[:n]); err != nil {
+					t.Fatalf("%s: %s: write: %v", encoding, tt.name, err)
+				}
+				p = p[n:]
+			}
+
+			if level := w.(*adaptiveWriter).Level(); !tt.expect(level) {
+				t.Fatalf("%s: %s: unexpected level %d", encoding, tt.name, level)
+			}
+
+			if err = w.Close(); err != nil {
+				t.Fatalf("%s: %s: close: %v", encoding, tt.name, err)
+			}
+
+			// A single, standard, stream.
+			if got := decompress(t, encoding, buf.Bytes()); !bytes.Equal(got, tt.data) {
+				t.Fatalf("%s: %s: the decompressed data do not match the original", encoding, tt.name)
+			}
+		}
+	}
+}
+
+func TestAdaptiveWriterReset(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewAdaptiveWriter(io.Discard, GZIP)
+	w.Write([]byte(strings.Repeat(testBody, 100)))
+
+	w.Reset(&buf)
+	if level := w.(*adaptiveWriter).Level(); level != adaptiveLevels[adaptiveStartLevel] {
+		t.Fatalf("expected the start level %d after reset but got %d", adaptiveLevels[adaptiveStartLevel], level)
+	}
+
+	io.WriteString(w, testBody)
+	w.Close()
+	if got := decompress(t, GZIP, buf.Bytes()); string(got) != testBody {
+		t.Fatalf("expected the original data but got %q", got)
+	}
+}
+
+func TestAdaptiveResponseWriterAutoFlush(t *testing.T) {
+	random := make([]byte, 4*AdaptiveWindow)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := []byte(strings.Repeat(testBody, 1+len(random)/len(testBody)))
+
+	tests := []struct {
+		name   string
+		data   []byte
+		expect func(level int) bool
+	}{
+		{"random data downshift", random, func(level int) bool { return level < adaptiveLevels[adaptiveStartLevel] }},
+		{"text upshift", text, func(level int) bool { return level > adaptiveLevels[adaptiveStartLevel] }},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		w, err := NewResponseWriter(rec, newTestRequest(GZIP), DefaultCompression, WithAdaptiveLevel())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Each write is flushed, the flushed blocks' overhead must not count as a poor ratio.
+		for p := tt.data; len(p) > 0; {
+			n := 100
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err = w.Write(p[:n]); err != nil {
+				t.Fatalf("%s: write: %v", tt.name, err)
+			}
+			p = p[n:]
+		}
+
+		if level := w.Writer.(*adaptiveWriter).Level(); !tt.expect(level) {
+			t.Fatalf("%s: unexpected level %d", tt.name, level)
+		}
+
+		if err = w.Close(); err != nil {
+			t.Fatalf("%s: close: %v", tt.name, err)
+		}
+		expectResponse(t, rec, GZIP, string(tt.data))
+	}
+}
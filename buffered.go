@@ -0,0 +1,85 @@
+package compress
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+)
+
+// bufferedResponse buffers the compressed output of a response writer
+// until it is closed, so the response is sent with its "Content-Length".
+// When the output exceeds the maximum size, the response is streamed instead.
+// See `WithFullBuffering`.
+type bufferedResponse struct {
+	w          http.ResponseWriter
+	buf        *bytes.Buffer
+	maxSize    int
+	statusCode int
+	streaming  bool
+}
+
+func newBufferedResponse(w http.ResponseWriter, maxSize int) *bufferedResponse {
+	return &bufferedResponse{
+		w:          w,
+		buf:        acquireBuffer(),
+		maxSize:    maxSize,
+		statusCode: http.StatusOK,
+	}
+}
+
+func (b *bufferedResponse) WriteHeader(statusCode int) {
+	if b.streaming {
+		b.w.WriteHeader(statusCode)
+		return
+	}
+
+	b.statusCode = statusCode
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.streaming {
+		return b.w.Write(p)
+	}
+
+	b.buf.Write(p)
+	if b.buf.Len() <= b.maxSize {
+		return len(p), nil
+	}
+
+	// The cap is exceeded, fall back to streaming without a "Content-Length".
+	if err := b.stream(); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// stream sends the header and the buffered data,
+// the next writes are sent to the client as they are written.
+func (b *bufferedResponse) stream() error {
+	b.streaming = true
+	b.w.WriteHeader(b.statusCode)
+
+	_, err := b.w.Write(b.buf.Bytes())
+	releaseBuffer(b.buf)
+	b.buf = nil
+	return err
+}
+
+// finish sends the whole buffered response along with its "Content-Length".
+func (b *bufferedResponse) finish() error {
+	if b.streaming {
+		return nil
+	}
+
+	b.w.Header().Set(ContentLengthHeaderKey, strconv.Itoa(b.buf.Len()))
+	return b.stream()
+}
+
+// release drops the buffered data, if any.
+func (b *bufferedResponse) release() {
+	if b.buf != nil {
+		releaseBuffer(b.buf)
+		b.buf = nil
+	}
+}
@@ -0,0 +1,43 @@
+package compress
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFullBuffering(t *testing.T) {
+	for _, encoding := range []string{GZIP, BROTLI, SNAPPY} {
+		// Many writes and flushes, the response is still sent at once.
+		h := WriteHandler(testHandler{body: testBody, chunkSize: 1000, flush: true}, WithFullBuffering(4096))
+		rec := serve(h, newTestRequest(encoding))
+		expectResponse(t, rec, encoding, testBody)
+
+		if expected, got := strconv.Itoa(rec.Body.Len()), rec.Header().Get(ContentLengthHeaderKey); got != expected {
+			t.Fatalf("%s: expected Content-Length %s, the compressed byte count, but got %q", encoding, expected, got)
+		}
+	}
+
+	// The compressed output exceeds the cap, the response is streamed.
+	random := randomText(64 << 10)
+	h := WriteHandler(testHandler{body: random, chunkSize: 1000, flush: true}, WithFullBuffering(4096))
+	rec := serve(h, newTestRequest(GZIP))
+	expectResponse(t, rec, GZIP, random)
+	if got := rec.Header().Get(ContentLengthHeaderKey); got != "" {
+		t.Fatalf("expected no Content-Length on a streamed response but got %q", got)
+	}
+}
+
+// randomText returns "n" bytes of hardly compressible text.
+func randomText(n int) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	rnd := rand.New(rand.NewSource(1))
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteByte(alphabet[rnd.Intn(len(alphabet))])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,192 @@
+package compress
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// responseCacheKey identifies a compressed response in the responseCache.
+type responseCacheKey struct {
+	host, path, query string
+	etag              string
+	encoding          string
+}
+
+type responseCacheEntry struct {
+	key  responseCacheKey
+	data []byte
+}
+
+// responseCache is a least recently used cache of compressed responses,
+// see `WithResponseCache`. It is safe for concurrent use.
+type responseCache struct {
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	entries map[responseCacheKey]*list.Element
+	lru     *list.List // of *responseCacheEntry, the most recently used first.
+}
+
+func newResponseCache(maxSize int) *responseCache {
+	return &responseCache{
+		maxSize: maxSize,
+		entries: make(map[responseCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the compressed response of the "key", if cached.
+// The returned data must not be modified.
+func (c *responseCache) get(key responseCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+	return e.Value.(*responseCacheEntry).data, true
+}
+
+// add caches the compressed response "data" of the "key",
+// it evicts the least recently used responses to stay within the size limit.
+func (c *responseCache) add(key responseCacheKey, data []byte) {
+	if len(data) > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.size -= len(e.Value.(*responseCacheEntry).data)
+		c.lru.Remove(e)
+	}
+
+	c.entries[key] = c.lru.PushFront(&responseCacheEntry{key: key, data: data})
+	c.size += len(data)
+
+	for c.size > c.maxSize {
+		e := c.lru.Back()
+		entry := e.Value.(*responseCacheEntry)
+		c.lru.Remove(e)
+		delete(c.entries, entry.key)
+		c.size -= len(entry.data)
+	}
+}
+
+// strongETag reports whether the "etag" is a strong entity tag, e.g. "xyzzy",
+// weak ones (W/"xyzzy") do not guarantee byte-identical responses.
+func strongETag(etag string) bool {
+	return len(etag) >= 2 && etag[0] == '"' && etag[len(etag)-1] == '"' &&
+		!strings.Contains(etag[1:len(etag)-1], `"`)
+}
+
+// cacheRecorder records the compressed response written to the underlying
+// response writer, to be stored in the responseCache on Close.
+type cacheRecorder struct {
+	http.ResponseWriter
+	cache             *responseCache
+	host, path, query string
+
+	key responseCacheKey
+	buf *bytes.Buffer // nil when not recording.
+}
+
+func (w *cacheRecorder) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if w.buf != nil {
+		if w.buf.Len()+n > w.cache.maxSize {
+			// It would not be cached anyway.
+			w.stop()
+		} else {
+			w.buf.Write(p[:n])
+		}
+	}
+
+	return n, err
+}
+
+func (w *cacheRecorder) FlushError() error {
+	return flushResponseWriter(w.ResponseWriter)
+}
+
+// Unwrap returns the underlying response writer,
+// e.g. for the http.ResponseController of Go 1.20+.
+func (w *cacheRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// start starts recording the response of the "key".
+func (w *cacheRecorder) start(key responseCacheKey) {
+	w.key = key
+	w.buf = acquireBuffer()
+}
+
+// stop stops recording, the response is not cached.
+func (w *cacheRecorder) stop() {
+	if w.buf != nil {
+		releaseBuffer(w.buf)
+		w.buf = nil
+	}
+}
+
+// store caches the recorded response.
+func (w *cacheRecorder) store() {
+	if w.buf == nil {
+		return
+	}
+
+	if w.buf.Len() > 0 {
+		w.cache.add(w.key, append([]byte(nil), w.buf.Bytes()...))
+	}
+	w.stop()
+}
+
+// serveCachedResponse is called by WriteHeader, when the response cache is enabled,
+// see `WithResponseCache`. It sends the cached compressed response
+// of the current ETag and encoding, if any, and it reports whether it did so.
+// Otherwise it starts recording the compressed response to be cached.
+func (w *ResponseWriter) serveCachedResponse(statusCode int) bool {
+	rec := w.recorder
+	w.recorder = nil
+
+	etag := w.Header().Get(ETagHeaderKey)
+	if statusCode != http.StatusOK || w.Encoding == IDENTITY || !strongETag(etag) {
+		return false
+	}
+
+	key := responseCacheKey{host: rec.host, path: rec.path, query: rec.query, etag: etag, encoding: w.Encoding}
+	data, ok := rec.cache.get(key)
+	if !ok {
+		rec.start(key)
+		w.recorder = rec
+		return false
+	}
+
+	// The compressor is not used at all, the data the handler writes are discarded.
+	w.dropBuffered()
+	w.releasePooledWriter()
+	w.Writer = discardWriter{}
+	w.servedFromCache = true
+
+	w.Header().Set(ContentLengthHeaderKey, strconv.Itoa(len(data)))
+	w.ResponseWriter.WriteHeader(statusCode)
+	_, _ = w.ResponseWriter.Write(data)
+	return true
+}
+
+// abortResponseCache stops recording the response, e.g. on a handler's panic,
+// so an incomplete response is not cached.
+func (w *ResponseWriter) abortResponseCache() {
+	if w.recorder != nil {
+		w.recorder.stop()
+		w.recorder = nil
+	}
+}
@@ -0,0 +1,114 @@
+package compress
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// countingCodec is the xorCodec which counts the writes of its writers,
+// so a test can tell whether a response was compressed or served from the cache.
+type countingCodec struct {
+	xorCodec
+	writes *int64
+}
+
+const countingEncoding = "x-counting"
+
+func (countingCodec) Name() string { return countingEncoding }
+
+func (c countingCodec) NewWriter(w io.Writer, level int) (Writer, error) {
+	return &countingWriter{xorWriter: xorWriter{w: w}, writes: c.writes}, nil
+}
+
+type countingWriter struct {
+	xorWriter
+	writes *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	atomic.AddInt64(w.writes, 1)
+	return w.xorWriter.Write(p)
+}
+
+var countingWrites int64
+
+func init() {
+	Register(countingCodec{writes: &countingWrites})
+}
+
+func TestResponseCache(t *testing.T) {
+	h := WriteHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ETagHeaderKey, r.URL.Query().Get("etag"))
+		writeTestBody(w, r)
+	}), WithOffers(countingEncoding), WithResponseCache(1<<20))
+
+	// do serves the request of the "target" and reports
+	// whether it was served from the cache.
+	do := func(target string) bool {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set(AcceptEncodingHeaderKey, countingEncoding)
+
+		writes := atomic.LoadInt64(&countingWrites)
+		rec := serve(h, r)
+		expectResponse(t, rec, countingEncoding, testBody)
+		if got := rec.Header().Get(ContentLengthHeaderKey); got != "" && got != strconv.Itoa(rec.Body.Len()) {
+			t.Fatalf("%s: expected Content-Length %d but got %s", target, rec.Body.Len(), got)
+		}
+
+		return atomic.LoadInt64(&countingWrites) == writes
+	}
+
+	tests := []struct {
+		target string
+		cached bool
+	}{
+		{`/a?etag="v1"`, false},
+		// The same response, the compressor is not invoked.
+		{`/a?etag="v1"`, true},
+		// The ETag changed.
+		{`/a?etag="v2"`, false},
+		{`/a?etag="v2"`, true},
+		// The query differs, e.g. a different page of the same path.
+		{`/a?etag="v2"&page=2`, false},
+		{`/a?etag="v2"&page=2`, true},
+		{`/b?etag="v1"`, false},
+		// Weak ETags are never cached.
+		{`/a?etag=W/"v1"`, false},
+		{`/a?etag=W/"v1"`, false},
+	}
+
+	for _, tt := range tests {
+		if cached := do(tt.target); cached != tt.cached {
+			t.Fatalf("%s: expected cached=%v but got %v", tt.target, tt.cached, cached)
+		}
+	}
+}
+
+func TestResponseCacheWritePrecompressed(t *testing.T) {
+	precompressed := compressData(t, GZIP, []byte(testBody))
+
+	h := WriteHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ETagHeaderKey, `"v1"`)
+		w.WriteHeader(http.StatusOK)
+		if err := w.(*ResponseWriter).WritePrecompressed(GZIP, precompressed); err != nil {
+			t.Errorf("write precompressed: %v", err)
+		}
+	}), WithResponseCache(1<<20))
+
+	for i := 0; i < 3; i++ {
+		rec := serve(h, newTestRequest(GZIP))
+		if rec.Body.Len() != len(precompressed) {
+			t.Fatalf("[%d] expected a single body of %d bytes but got %d", i, len(precompressed), rec.Body.Len())
+		}
+		if got := rec.Header().Get(ContentLengthHeaderKey); i > 0 && got != strconv.Itoa(len(precompressed)) {
+			t.Fatalf("[%d] expected the cached Content-Length %d but got %q", i, len(precompressed), got)
+		}
+		expectResponse(t, rec, GZIP, testBody)
+	}
+}
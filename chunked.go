@@ -0,0 +1,156 @@
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+const (
+	// minChunkPartSize is the minimum part size of a ChunkedWriter.
+	minChunkPartSize = 1024
+	// chunkCloseOverhead is the maximum size of the data an encoder writes on Close,
+	// e.g. the gzip trailer, reserved at the end of each chunk.
+	chunkCloseOverhead = 128
+	// minChunkSegment is the minimum amount of data written to a chunk at once,
+	// when less fits in its free space the chunk is finished.
+	minChunkSegment = 64
+)
+
+// ChunkedWriter compresses data into independent compressed streams ("chunks"),
+// each one of them up to a part size, e.g. for uploading to a storage
+// which limits the size of each part.
+// Each chunk can be decompressed by `NewReader` on its own,
+// the decompressed chunks, in order, form the original data.
+// It is not safe for concurrent use.
+type ChunkedWriter struct {
+	w        Writer
+	buf      bytes.Buffer
+	partSize int
+	onChunk  func(chunk []byte) error
+
+	unflushed int  // the input written to the encoder since its last flush.
+	dirty     bool // true when the current chunk contains data.
+	closed    bool
+}
+
+var _ io.WriteCloser = (*ChunkedWriter)(nil)
+
+// NewChunkedWriter returns a new ChunkedWriter based on the given "encoding" and "level",
+// see `NewWriter`. It calls the "onChunk" function with each finished chunk
+// of "partSize" compressed bytes at most. The chunk's data are valid only
+// during the call, they should be copied to be retained.
+//
+// A chunk is finished when the compressed output would exceed the "partSize"
+// and on Close. The writer assumes the worst case expansion of the builtin encodings
+// for the input which is not flushed yet and it flushes the encoder,
+// to measure its actual output, only when that input could not fit the chunk otherwise,
+// so small writes do not hurt the compression ratio.
+// Chunks are usually a bit smaller than the "partSize".
+// The "partSize" should be at least 1024 bytes.
+func NewChunkedWriter(encoding string, level int, partSize int, onChunk func(chunk []byte) error, opts ...Option) (*ChunkedWriter, error) {
+	if partSize < minChunkPartSize {
+		return nil, fmt.Errorf("compress: chunk part size should be at least %d bytes", minChunkPartSize)
+	}
+
+	cw := &ChunkedWriter{
+		partSize: partSize,
+		onChunk:  onChunk,
+	}
+
+	w, err := newWriter(&cw.buf, encoding, level, newConfig(opts).writer)
+	if err != nil {
+		return nil, err
+	}
+	cw.w = w
+
+	return cw, nil
+}
+
+// Write compresses the "p" into the current chunk,
+// it finishes and starts new chunks as they are filled.
+func (cw *ChunkedWriter) Write(p []byte) (int, error) {
+	if cw.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n := 0
+	for len(p) > 0 {
+		size := cw.segmentSize()
+		if size < minChunkSegment {
+			if cw.unflushed > 0 {
+				// Flush to measure the actual compressed size of the chunk,
+				// it is usually much smaller than the worst case.
+				if err := cw.w.Flush(); err != nil {
+					return n, err
+				}
+				cw.unflushed = 0
+				continue
+			}
+
+			if err := cw.finishChunk(); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		if size > len(p) {
+			size = len(p)
+		}
+
+		if _, err := cw.w.Write(p[:size]); err != nil {
+			return n, err
+		}
+
+		cw.unflushed += size
+		cw.dirty = true
+		n += size
+		p = p[size:]
+	}
+
+	return n, nil
+}
+
+// segmentSize returns the maximum amount of data which can be written
+// to the current chunk without exceeding the part size,
+// based on the worst case expansion of the builtin encodings:
+// n + n/6 + 64 bytes for n bytes of input, which includes the input
+// written since the last flush of the encoder.
+func (cw *ChunkedWriter) segmentSize() int {
+	free := cw.partSize - cw.buf.Len() - chunkCloseOverhead - minChunkSegment
+	if free <= 0 {
+		return 0
+	}
+
+	return free*6/7 - cw.unflushed
+}
+
+// finishChunk closes the encoder of the current chunk, it passes the chunk
+// to the onChunk function and it starts a new one.
+func (cw *ChunkedWriter) finishChunk() error {
+	if err := cw.w.Close(); err != nil {
+		return err
+	}
+
+	err := cw.onChunk(cw.buf.Bytes())
+	cw.buf.Reset()
+	cw.w.Reset(&cw.buf)
+	cw.unflushed = 0
+	cw.dirty = false
+	return err
+}
+
+// Close finishes the last chunk, if it contains any data.
+// Calling Close more than once has no effect.
+func (cw *ChunkedWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+
+	if !cw.dirty {
+		return nil
+	}
+
+	return cw.finishChunk()
+}
@@ -0,0 +1,102 @@
+package compress
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestChunkedWriter(t *testing.T) {
+	const partSize = 4096
+
+	random := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	inputs := map[string][]byte{
+		"compressible":   []byte(strings.Repeat(testBody, 20)),
+		"incompressible": random,
+	}
+
+	for _, encoding := range []string{GZIP, DEFLATE, BROTLI, SNAPPY, S2} {
+		for name, data := range inputs {
+			var chunks [][]byte
+			cw, err := NewChunkedWriter(encoding, DefaultCompression, partSize, func(chunk []byte) error {
+				chunks = append(chunks, append([]byte(nil), chunk...))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Writes of various sizes.
+			for rest, n := data, 1; len(rest) > 0; n = n*3 + 1 {
+				if n > len(rest) {
+					n = len(rest)
+				}
+				if _, err = cw.Write(rest[:n]); err != nil {
+					t.Fatalf("%s: %s: write: %v", encoding, name, err)
+				}
+				rest = rest[n:]
+			}
+			if err = cw.Close(); err != nil {
+				t.Fatalf("%s: %s: close: %v", encoding, name, err)
+			}
+
+			if name == "incompressible" && len(chunks) < len(data)/partSize {
+				t.Fatalf("%s: %s: expected at least %d chunks but got %d", encoding, name, len(data)/partSize, len(chunks))
+			}
+
+			var decoded []byte
+			for i, chunk := range chunks {
+				if len(chunk) > partSize {
+					t.Fatalf("%s: %s: chunk %d: expected up to %d bytes but got %d", encoding, name, i, partSize, len(chunk))
+				}
+				decoded = append(decoded, decompress(t, encoding, chunk)...)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Fatalf("%s: %s: expected the chunks to decode to the original data", encoding, name)
+			}
+		}
+	}
+}
+
+func TestChunkedWriterSmallWrites(t *testing.T) {
+	const partSize = 64 << 10
+
+	data := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 25000))[:1100000]
+
+	// The snappy writer frames each write on its own, whatever the chunking.
+	for _, encoding := range []string{GZIP, DEFLATE, BROTLI, S2} {
+		var (
+			total   int
+			decoded []byte
+		)
+		cw, err := NewChunkedWriter(encoding, DefaultCompression, partSize, func(chunk []byte) error {
+			total += len(chunk)
+			decoded = append(decoded, decompress(t, encoding, chunk)...)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for rest := data; len(rest) > 0; rest = rest[100:] {
+			if _, err = cw.Write(rest[:100]); err != nil {
+				t.Fatalf("%s: write: %v", encoding, err)
+			}
+		}
+		if err = cw.Close(); err != nil {
+			t.Fatalf("%s: close: %v", encoding, err)
+		}
+
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("%s: expected the chunks to decode to the original data", encoding)
+		}
+		// Repetitive text compresses far below 1% of its size in a single stream,
+		// small writes must not flush the encoder each time.
+		if limit := len(data) / 100; total > limit {
+			t.Fatalf("%s: expected up to %d compressed bytes but got %d", encoding, limit, total)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package compress
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	// Pick the fastest compression packages for the job.
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/s2" // Snappy output but likely faster decompression.
+	"github.com/klauspost/compress/snappy"
+)
+
+// Codec is the interface which a compression algorithm should implement
+// in order to be used by the package's writers, readers and middlewares.
+// See `Register`.
+type Codec interface {
+	// Name returns the content-coding token of the algorithm, e.g. "gzip".
+	Name() string
+	// Standard reports whether the encoding belongs to the default offers,
+	// so it can be selected when the client accepts it or any ("*") encoding.
+	Standard() bool
+	// NewWriter returns a Writer of "w" which compresses using the given "level".
+	NewWriter(w io.Writer, level int) (Writer, error)
+	// NewReader returns a reader of "r" which decompresses its data.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[string]Codec)
+)
+
+// Register makes a Codec available by its name.
+// If a codec of the same name is already registered, it is replaced,
+// so builtin codecs can be overridden too.
+// A Standard codec is added to the `DefaultOffers`, by its lowercase name,
+// and a codec which replaces a Standard one but it is not Standard itself is removed from them.
+// The DefaultOffers are replaced by a new slice, the slices read before are not modified.
+//
+// Register should be called on initialization, e.g. on an init function,
+// before any writer or handler is created: the DefaultOffers variable
+// is read by the handlers without a lock.
+// It panics if the codec is nil or its name is empty.
+func Register(c Codec) {
+	if c == nil || c.Name() == "" {
+		panic("compress: Register codec is nil or has an empty name")
+	}
+
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	name := strings.ToLower(c.Name())
+	codecs[name] = c
+
+	offers := make([]string, 0, len(DefaultOffers)+1)
+	found := false
+	for _, offer := range DefaultOffers {
+		if !strings.EqualFold(offer, name) {
+			offers = append(offers, offer)
+			continue
+		}
+
+		// Keep the position of a replaced offer.
+		if c.Standard() && !found {
+			offers = append(offers, name)
+		}
+		found = true
+	}
+	if c.Standard() && !found {
+		offers = append(offers, name)
+	}
+
+	DefaultOffers = offers
+}
+
+// LookupCodec returns the registered Codec of the given "encoding".
+// Content-coding values are case-insensitive, so is the lookup.
+func LookupCodec(encoding string) (Codec, bool) {
+	codecsMu.RLock()
+	c, ok := codecs[strings.ToLower(encoding)]
+	codecsMu.RUnlock()
+	return c, ok
+}
+
+// SupportedEncodings returns the sorted names of the registered encodings.
+func SupportedEncodings() []string {
+	codecsMu.RLock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	codecsMu.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// canonicalEncoding returns the lowercase token of a known "encoding",
+// e.g. "gzip" for "GZIP". Unknown encodings are returned as they are.
+func canonicalEncoding(encoding string) string {
+	if strings.EqualFold(encoding, IDENTITY) {
+		return IDENTITY
+	}
+
+	if _, ok := LookupCodec(encoding); ok {
+		return strings.ToLower(encoding)
+	}
+
+	return encoding
+}
+
+// codec is the Codec implementation of the builtin compression algorithms.
+type codec struct {
+	name      string
+	standard  bool
+	newWriter func(w io.Writer, level int) (Writer, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var _ Codec = (*codec)(nil)
+
+func (c *codec) Name() string                                     { return c.name }
+func (c *codec) Standard() bool                                   { return c.standard }
+func (c *codec) NewWriter(w io.Writer, level int) (Writer, error) { return c.newWriter(w, level) }
+func (c *codec) NewReader(r io.Reader) (io.ReadCloser, error)     { return c.newReader(r) }
+
+func init() {
+	Register(&codec{
+		name:     GZIP,
+		standard: true,
+		newWriter: func(w io.Writer, level int) (Writer, error) {
+			cw, err := gzip.NewWriterLevel(w, level)
+			if err != nil {
+				return nil, err
+			}
+			return cw, nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			rc, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return rc, nil
+		},
+	})
+
+	Register(&codec{
+		name:     DEFLATE,
+		standard: true,
+		newWriter: func(w io.Writer, level int) (Writer, error) {
+			cw, err := flate.NewWriter(w, level)
+			if err != nil {
+				return nil, err
+			}
+			return cw, nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	})
+
+	Register(&codec{
+		name:     BROTLI,
+		standard: true,
+		newWriter: func(w io.Writer, level int) (Writer, error) {
+			return brotli.NewWriterLevel(w, normalizeLevel(BROTLI, level)), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return &noOpReadCloser{brotli.NewReader(r)}, nil
+		},
+	})
+
+	Register(&codec{
+		name:     SNAPPY,
+		standard: true,
+		newWriter: func(w io.Writer, level int) (Writer, error) {
+			return snappy.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return &noOpReadCloser{snappy.NewReader(r)}, nil
+		},
+	})
+
+	Register(&codec{
+		name: S2,
+		newWriter: func(w io.Writer, level int) (Writer, error) {
+			return s2.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return &noOpReadCloser{s2.NewReader(r)}, nil
+		},
+	})
+}
@@ -0,0 +1,151 @@
+package compress
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// xorCodec is a custom, non-standard, codec which xors each byte with a key.
+type xorCodec struct{}
+
+const xorEncoding = "x-xor"
+
+func (xorCodec) Name() string   { return xorEncoding }
+func (xorCodec) Standard() bool { return false }
+
+func (xorCodec) NewWriter(w io.Writer, level int) (Writer, error) {
+	return &xorWriter{w: w}, nil
+}
+
+func (xorCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(&xorReader{r: r}), nil
+}
+
+func xor(p []byte) []byte {
+	out := make([]byte, len(p))
+	for i, b := range p {
+		out[i] = b ^ 0x5a
+	}
+	return out
+}
+
+type xorWriter struct {
+	w io.Writer
+}
+
+func (w *xorWriter) Write(p []byte) (int, error) { return w.w.Write(xor(p)) }
+func (w *xorWriter) Flush() error                { return nil }
+func (w *xorWriter) Close() error                { return nil }
+func (w *xorWriter) Reset(dst io.Writer)         { w.w = dst }
+
+type xorReader struct {
+	r io.Reader
+}
+
+func (r *xorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	copy(p, xor(p[:n]))
+	return n, err
+}
+
+func init() {
+	Register(xorCodec{})
+}
+
+func TestRegisterCodec(t *testing.T) {
+	c, ok := LookupCodec("X-XOR")
+	if !ok || c.Name() != xorEncoding {
+		t.Fatalf("expected the %q codec to be registered", xorEncoding)
+	}
+
+	for _, offer := range DefaultOffers {
+		if offer == xorEncoding {
+			t.Fatalf("expected a non-standard codec not to be a default offer")
+		}
+	}
+
+	found := false
+	for _, encoding := range SupportedEncodings() {
+		found = found || encoding == xorEncoding
+	}
+	if !found {
+		t.Fatalf("expected %q in the supported encodings %v", xorEncoding, SupportedEncodings())
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, xorEncoding, DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, testBody)
+	w.Close()
+
+	if bytes.Equal(buf.Bytes(), []byte(testBody)) {
+		t.Fatal("expected the data to be encoded")
+	}
+	if got := decompress(t, xorEncoding, buf.Bytes()); string(got) != testBody {
+		t.Fatalf("expected the original data but got %q", got)
+	}
+}
+
+func TestRegisterCodecHandler(t *testing.T) {
+	h := Handler(http.HandlerFunc(echoBody), WithOffers(xorEncoding, GZIP))
+
+	r := newUploadRequest(xorEncoding, xor([]byte(testBody)))
+	r.Header.Set(AcceptEncodingHeaderKey, "gzip, x-xor")
+	expectResponse(t, serve(h, r), xorEncoding, testBody)
+}
+
+func TestRegisterInvalidCodec(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected Register to panic on a nil codec")
+		}
+	}()
+
+	Register(nil)
+}
+
+// upperCodec is a codec of an uppercase name, its "standard" field
+// makes it a default offer or not.
+type upperCodec struct {
+	xorCodec
+	standard bool
+}
+
+func (upperCodec) Name() string     { return "X-UPPER" }
+func (c upperCodec) Standard() bool { return c.standard }
+
+func TestRegisterDefaultOffers(t *testing.T) {
+	offers := DefaultOffers
+	snapshot := append([]string(nil), offers...)
+	defer func() {
+		codecsMu.Lock()
+		delete(codecs, "x-upper")
+		codecsMu.Unlock()
+		DefaultOffers = offers
+	}()
+
+	Register(upperCodec{standard: true})
+	Register(upperCodec{standard: true})
+
+	expected := append(append([]string(nil), snapshot...), "x-upper")
+	if !reflect.DeepEqual(DefaultOffers, expected) {
+		t.Fatalf("expected the default offers %v but got %v", expected, DefaultOffers)
+	}
+	if !reflect.DeepEqual(offers, snapshot) {
+		t.Fatalf("expected the previous default offers to be kept but got %v", offers)
+	}
+
+	// Replaced by a non-standard codec, it is no longer offered.
+	Register(upperCodec{})
+	if !reflect.DeepEqual(DefaultOffers, snapshot) {
+		t.Fatalf("expected the default offers %v but got %v", snapshot, DefaultOffers)
+	}
+	if c, ok := LookupCodec("x-upper"); !ok || c.Standard() {
+		t.Fatalf("expected the non-standard codec to replace the standard one")
+	}
+}
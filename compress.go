@@ -1,17 +1,18 @@
 package compress
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	// Pick the fastest compression packages for the job.
 	"github.com/andybalholm/brotli"
-	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/gzip"
-	"github.com/klauspost/compress/s2" // Snappy output but likely faster decompression.
-	"github.com/klauspost/compress/snappy"
 )
 
 // The available builtin compression algorithms.
@@ -39,26 +40,115 @@ var (
 	// when the request's Accept-Encoding was not found in the server's supported
 	// compression algorithms. Check that error with `errors.Is`.
 	ErrNotSupportedCompression = errors.New("compress: unsupported compression")
+	// ErrNotAcceptable returned from NewResponseWriter, on strict negotiation,
+	// when the client accepts none of the server's encodings
+	// and it explicitly refuses the "identity" one too. See `WithStrictNegotiation`.
+	ErrNotAcceptable = errors.New("compress: no acceptable encoding")
+	// ErrDecompressedBodyTooLarge returned from the Reader's Read, wrapped by a `BodyTooLargeError`,
+	// when the decompressed data exceed the `WithMaxDecompressedSize` limit.
+	ErrDecompressedBodyTooLarge = errors.New("compress: decompressed body too large")
+	// ErrBodyNotSeekable returned from the Reader's Seekable when its decompressed data
+	// are not buffered, see `WithSeekableBody`.
+	ErrBodyNotSeekable = errors.New("compress: body is not seekable")
 )
 
+// BodyTooLargeError is returned from the Reader's Read, and `NewReader`,
+// when a size limit of the request body is exceeded.
+// It distinguishes the two limits a compressed body can be bound to:
+//   - the compressed size, the body was wrapped by an `http.MaxBytesReader`
+//     before it is passed to the reader, Err is the *http.MaxBytesError.
+//   - the decompressed size, see `WithMaxDecompressedSize`,
+//     Err is the `ErrDecompressedBodyTooLarge`.
+//
+// Check that error with `errors.As`.
+type BodyTooLargeError struct {
+	// Compressed reports whether the compressed size limit was exceeded,
+	// otherwise it is the decompressed one.
+	Compressed bool
+	// Limit is the size limit that was exceeded.
+	Limit int64
+	Err   error
+}
+
+func (e *BodyTooLargeError) Error() string {
+	if e.Compressed {
+		return fmt.Sprintf("compress: compressed body too large: limit of %d bytes", e.Limit)
+	}
+
+	return fmt.Sprintf("%v: limit of %d bytes", e.Err, e.Limit)
+}
+
+func (e *BodyTooLargeError) Unwrap() error {
+	return e.Err
+}
+
+// compressedBodyTooLarge returns a compressed `BodyTooLargeError` if "err"
+// is an *http.MaxBytesError of the source, otherwise it returns "err" as it is.
+func compressedBodyTooLarge(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &BodyTooLargeError{Compressed: true, Limit: maxBytesErr.Limit, Err: err}
+	}
+
+	return err
+}
+
 // DefaultOffers is a slice of default content encodings.
 // See `NewResponseWriter`.
 var DefaultOffers = []string{GZIP, DEFLATE, BROTLI, SNAPPY}
 
 // GetEncoding extracts the best available encoding from the request.
 func GetEncoding(r *http.Request, offers []string) (string, error) {
-	acceptEncoding := r.Header[AcceptEncodingHeaderKey]
+	encoding, _, err := getEncoding(r, offers, nil)
+	return encoding, err
+}
+
+// getEncoding is like GetEncoding but it applies the options of "c", if not nil.
+// It reports whether the encoding was chosen by the `WithEncodingChooser`
+// or forced by the `WithUserAgentFilter`, so it must not be re-negotiated,
+// see `WithContentLengthHint`.
+func getEncoding(r *http.Request, offers []string, c *config) (encoding string, chosen bool, err error) {
+	acceptEncoding := acceptEncodingValues(r, c)
 
 	if len(acceptEncoding) == 0 {
-		return "", ErrResponseNotCompressed
+		return "", false, ErrResponseNotCompressed
+	}
+
+	if c != nil && c.userAgentFilter != nil {
+		allowEncoding, forceEncoding := c.userAgentFilter(r.UserAgent())
+		if !allowEncoding || strings.EqualFold(forceEncoding, IDENTITY) {
+			return "", false, ErrResponseNotCompressed
+		}
+
+		if forceEncoding != "" {
+			if _, ok := LookupCodec(forceEncoding); ok {
+				forceEncoding = canonicalEncoding(forceEncoding)
+				if len(acceptedOffers(acceptEncoding, []string{forceEncoding}, c.maxAcceptSpecs)) > 0 {
+					return forceEncoding, true, nil
+				}
+			}
+		}
+	}
+
+	if c != nil && c.encodingChooser != nil {
+		if candidates := acceptedOffers(acceptEncoding, offers, c.maxAcceptSpecs); len(candidates) > 0 {
+			encoding = c.encodingChooser(r, candidates)
+			for _, candidate := range candidates {
+				if candidate == encoding {
+					return encoding, true, nil
+				}
+			}
+
+			return candidates[0], false, nil
+		}
 	}
 
-	encoding := negotiateAcceptHeader(acceptEncoding, offers, IDENTITY)
+	encoding = negotiateAcceptHeader(acceptEncoding, offers, IDENTITY, c.acceptSpecsLimit())
 	if encoding == "" {
-		return "", fmt.Errorf("%w: %s", ErrNotSupportedCompression, encoding)
+		return "", false, fmt.Errorf("%w: %s", ErrNotSupportedCompression, encoding)
 	}
 
-	return encoding, nil
+	return encoding, false, nil
 }
 
 // Writer is an interface which all compress writers should implement.
@@ -66,33 +156,109 @@ type Writer interface {
 	io.WriteCloser
 	// All known implementations contain `Flush`, `Reset` (and `Close`) methods,
 	// so we wanna declare them upfront.
+	//
+	// Flush writes any pending data, as a complete block of the encoding,
+	// so a decoder can fully decode the stream written so far, before Close,
+	// e.g. for live streaming. All builtin encodings flush that way,
+	// brotli through its flush operation and gzip and deflate through a sync flush.
 	Flush() error
 	Reset(io.Writer)
 }
 
+// Compression levels shared across the encodings which accept a level.
+// Snappy and S2 do not accept a level, it is ignored.
+//
+// Supported levels per encoding:
+//   - gzip and deflate: HuffmanOnly (-2), DefaultCompression (-1, same as 5),
+//     0 (no compression) and 1 (best speed) to 9 (best compression).
+//   - brotli: DefaultCompression (-1, same as 6) and 0 (best speed) to 11 (best compression).
+//     Brotli has no Huffman-only strategy, HuffmanOnly maps to its best speed level (0).
+const (
+	// NoCompression stores the data without compressing them.
+	NoCompression = 0
+	// DefaultCompression selects the default level of the encoding.
+	DefaultCompression = -1
+	// HuffmanOnly disables Lempel-Ziv match searching and only performs Huffman
+	// entropy encoding. It is very fast and it is useful for data
+	// that are mostly incompressible but still need to be framed in the encoding.
+	HuffmanOnly = -2
+)
+
+// normalizeLevel returns the level that is actually used by the "encoding".
+func normalizeLevel(encoding string, level int) int {
+	if encoding == BROTLI {
+		switch {
+		case level == DefaultCompression:
+			return brotli.DefaultCompression
+		case level < 0:
+			return brotli.BestSpeed
+		}
+	}
+
+	return level
+}
+
 // NewWriter returns a Writer of "w" based on the given "encoding".
-func NewWriter(w io.Writer, encoding string, level int) (cw Writer, err error) {
-	switch encoding {
-	case GZIP:
-		cw, err = gzip.NewWriterLevel(w, level)
-	case DEFLATE: // -1 default level, same for gzip.
-		cw, err = flate.NewWriter(w, level)
-	case BROTLI: // 6 default level.
-		if level == -1 {
-			level = 6
+// The "level" is the compression level, see `DefaultCompression` and `HuffmanOnly`.
+// The "encoding" should be a registered one, see `Register`.
+//
+// Optional "opts" can be passed to customize encoding-specific settings,
+// e.g. `WithBrotliWindow`.
+func NewWriter(w io.Writer, encoding string, level int, opts ...Option) (Writer, error) {
+	return newWriter(w, encoding, level, newConfig(opts).writer)
+}
+
+func newWriter(w io.Writer, encoding string, level int, wo writerOptions) (Writer, error) {
+	// Throw if "identity" is given. As this is not acceptable on "Content-Encoding" header.
+	// Only Accept-Encoding (client) can use that; it means, no transformation whatsoever.
+	c, ok := LookupCodec(encoding)
+	if !ok {
+		return nil, ErrNotSupportedCompression
+	}
+
+	encoding = canonicalEncoding(encoding)
+	level = normalizeLevel(encoding, level)
+
+	if encoding == BROTLI && wo.brotliLGWin > 0 {
+		return brotli.NewWriterOptions(w, brotli.WriterOptions{
+			Quality: level,
+			LGWin:   wo.brotliLGWin,
+		}), nil
+	}
+
+	cw, err := c.NewWriter(w, level)
+	if err != nil {
+		return nil, err
+	}
+
+	if encoding == GZIP && wo.reproducibleGzip {
+		if gw, ok := cw.(*gzip.Writer); ok {
+			rw := &reproducibleGzipWriter{gw}
+			rw.setHeader()
+			return rw, nil
 		}
-		cw = brotli.NewWriterLevel(w, level)
-	case SNAPPY:
-		cw = snappy.NewWriter(w)
-	case S2:
-		cw = s2.NewWriter(w)
-	default:
-		// Throw if "identity" is given. As this is not acceptable on "Content-Encoding" header.
-		// Only Accept-Encoding (client) can use that; it means, no transformation whatsoever.
-		err = ErrNotSupportedCompression
 	}
 
-	return
+	return cw, nil
+}
+
+// Underlying returns the concrete compressor behind the given Writer,
+// e.g. a *gzip.Writer of the klauspost/compress package or a *brotli.Writer,
+// so advanced callers can type-assert it to use library-specific methods.
+//
+// Writers which wrap a compressor, e.g. the ones returned by `NewAdaptiveWriter`,
+// are unwrapped through their `Underlying() interface{}` method,
+// custom Codec writers may implement it too. See `ResponseWriter.Underlying` as well.
+// Any other Writer, e.g. the ones returned by `NewWriter`, is the compressor itself.
+//
+// Note that writing, flushing or resetting the compressor directly
+// bypasses the wrapper's state.
+func Underlying(w Writer) interface{} {
+	if u, ok := w.(interface{ Underlying() interface{} }); ok {
+		return u.Underlying()
+	}
+
+	return w
 }
 
 // Reader is a structure which wraps a compressed reader.
@@ -104,39 +270,69 @@ type Reader struct {
 	Src io.ReadCloser
 	// Encoding is the compression alogirthm is used to decompress and read the data.
 	Encoding string
+
+	compressed   *countReader
+	decompressed int64
 }
 
 // NewReader returns a new "Reader" wrapper of "src".
 // It returns `ErrRequestNotCompressed` if client's request data are not compressed
 // or `ErrNotSupportedCompression` if server missing the decompression algorithm.
 // Note: on server-side the request body (src) will be closed automaticaly.
-func NewReader(src io.Reader, encoding string) (*Reader, error) {
-	if encoding == "" || src == nil {
+//
+// Optional "opts" can be passed to customize the reader, e.g. `WithReadAheadLimit`.
+func NewReader(src io.Reader, encoding string, opts ...Option) (*Reader, error) {
+	return newReader(src, encoding, newConfig(opts))
+}
+
+func newReader(src io.Reader, encoding string, c *config) (*Reader, error) {
+	if encoding == "" || strings.EqualFold(encoding, IDENTITY) || src == nil {
 		return nil, ErrRequestNotCompressed
 	}
 
+	codec, ok := LookupCodec(encoding)
+	if !ok {
+		return nil, ErrNotSupportedCompression
+	}
+	encoding = canonicalEncoding(encoding)
+
+	compressed := &countReader{Reader: src}
+	var in io.Reader = compressed
+	if br, ok := src.(io.ByteReader); ok {
+		// Keep the decoders from buffering a source which is already an io.ByteReader.
+		in = &countByteReader{compressed, br}
+	}
+
+	if c.readAheadLimit > 0 {
+		in = &readAheadLimitReader{compressed, c.readAheadLimit}
+		if encoding == GZIP || encoding == DEFLATE {
+			// Their decoders buffer any reader which is not an io.ByteReader,
+			// give them one of the limit's size instead of their default.
+			in = bufio.NewReaderSize(in, c.readAheadLimit)
+		}
+	}
+
 	var (
 		rc  io.ReadCloser
 		err error
 	)
+	if c.skipChecksumVerification && encoding == GZIP {
+		rc, err = newUncheckedGzipReader(in)
+	} else {
+		rc, err = codec.NewReader(in)
+	}
+	if err != nil {
+		return nil, compressedBodyTooLarge(err)
+	}
 
-	switch encoding {
-	case GZIP:
-		rc, err = gzip.NewReader(src)
-	case DEFLATE:
-		rc = flate.NewReader(src)
-	case BROTLI:
-		rc = &noOpReadCloser{brotli.NewReader(src)}
-	case SNAPPY:
-		rc = &noOpReadCloser{snappy.NewReader(src)}
-	case S2:
-		rc = &noOpReadCloser{s2.NewReader(src)}
-	default:
-		err = ErrNotSupportedCompression
+	if c.maxDecompressedSize > 0 {
+		rc = &maxSizeReadCloser{ReadCloser: rc, limit: c.maxDecompressedSize, remaining: c.maxDecompressedSize}
 	}
 
-	if err != nil {
-		return nil, err
+	if c.seekableBodyBuffer > 0 {
+		if rc, err = newSeekableReadCloser(rc, c.seekableBodyBuffer); err != nil {
+			return nil, compressedBodyTooLarge(err)
+		}
 	}
 
 	srcReadCloser, ok := src.(io.ReadCloser)
@@ -148,11 +344,84 @@ func NewReader(src io.Reader, encoding string) (*Reader, error) {
 		ReadCloser: rc,
 		Src:        srcReadCloser,
 		Encoding:   encoding,
+		compressed: compressed,
 	}
 
 	return v, nil
 }
 
+// Read reads and decompresses data from the source.
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.decompressed += int64(n)
+	if err != nil && err != io.EOF {
+		err = compressedBodyTooLarge(err)
+	}
+	return n, err
+}
+
+// Seekable returns a seekable reader of the decompressed body
+// if it is buffered, see `WithSeekableBody`, otherwise it returns `ErrBodyNotSeekable`.
+func (r *Reader) Seekable() (*SeekableReader, error) {
+	body, ok := r.ReadCloser.(*seekableReadCloser)
+	if !ok {
+		return nil, ErrBodyNotSeekable
+	}
+
+	return &SeekableReader{Reader: r, body: body}, nil
+}
+
+// CompressedBytesRead returns the amount of compressed bytes read from the source so far.
+// Decoders read ahead, so it may be larger than the data consumed
+// by the decompressed bytes read so far.
+func (r *Reader) CompressedBytesRead() int64 {
+	if r.compressed == nil {
+		return 0
+	}
+
+	return r.compressed.n
+}
+
+// DecompressedBytesRead returns the amount of decompressed bytes read so far.
+// Together with `CompressedBytesRead` it can be used to log the efficiency
+// of the compressed uploads once the data are fully read.
+func (r *Reader) DecompressedBytesRead() int64 {
+	return r.decompressed
+}
+
+// SeekableReader is a Reader of a decompressed body which is buffered in memory,
+// it implements io.Seeker, e.g. for frameworks which seek the request body
+// to 0 in order to read it again. See `Reader.Seekable` and `WithSeekableBody`.
+type SeekableReader struct {
+	*Reader
+
+	body *seekableReadCloser
+}
+
+var _ io.ReadSeekCloser = (*SeekableReader)(nil)
+
+// Read reads the buffered decompressed data.
+// Its `DecompressedBytesRead` is the furthest offset read,
+// data read again after a Seek are not counted twice.
+func (r *SeekableReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if offset := r.body.Size() - int64(r.body.Len()); offset > r.decompressed {
+		r.decompressed = offset
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next Read on the decompressed data.
+func (r *SeekableReader) Seek(offset int64, whence int) (int64, error) {
+	return r.body.Seek(offset, whence)
+}
+
+// String returns a debug representation of the reader, e.g.
+// compress.Reader{encoding=gzip}.
+func (r *Reader) String() string {
+	return "compress.Reader{encoding=" + r.Encoding + "}"
+}
+
 // Header keys.
 const (
 	AcceptEncodingHeaderKey  = "Accept-Encoding"
@@ -160,13 +429,53 @@ const (
 	ContentEncodingHeaderKey = "Content-Encoding"
 	ContentLengthHeaderKey   = "Content-Length"
 	ContentTypeHeaderKey     = "Content-Type"
+	UserAgentHeaderKey       = "User-Agent"
+	ETagHeaderKey            = "ETag"
 )
 
 // AddCompressHeaders just adds the headers "Vary" to "Accept-Encoding"
 // and "Content-Encoding" to the given encoding.
+// A known encoding is always written in its canonical, lowercase, form.
+// Any other "Vary" values, e.g. "User-Agent", are kept.
 func AddCompressHeaders(h http.Header, encoding string) {
-	h.Set(VaryHeaderKey, AcceptEncodingHeaderKey)
-	h.Set(ContentEncodingHeaderKey, encoding)
+	addCompressHeaders(h, ContentEncodingHeaderKey, encoding)
+}
+
+// addCompressHeaders is like AddCompressHeaders but the encoding
+// is written to the "contentEncodingKey" header, see `WithContentEncodingHeaderKey`.
+func addCompressHeaders(h http.Header, contentEncodingKey, encoding string) {
+	addVary(h, AcceptEncodingHeaderKey)
+	h.Set(contentEncodingKey, canonicalEncoding(encoding))
+}
+
+// addVary adds the header "key" to the "Vary" header values, if it is not listed already,
+// e.g. "Vary: Accept-Encoding, User-Agent".
+func addVary(h http.Header, key string) {
+	values := h[VaryHeaderKey]
+	for _, v := range values {
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, key) {
+				return
+			}
+		}
+	}
+
+	if n := len(values); n > 0 && values[n-1] != "" {
+		values[n-1] += ", " + key
+		return
+	}
+
+	h.Set(VaryHeaderKey, key)
+}
+
+// canonicalizeContentEncoding rewrites the "Content-Encoding" header values,
+// or of the given "contentEncodingKey" header, of known encodings
+// to their canonical, lowercase, form. Unknown encodings are left as they are.
+func canonicalizeContentEncoding(h http.Header, contentEncodingKey string) {
+	values := h[http.CanonicalHeaderKey(contentEncodingKey)]
+	for i, v := range values {
+		values[i] = canonicalEncoding(v)
+	}
 }
 
 // ResponseWriter is a compressed data http.ResponseWriter.
@@ -179,6 +488,31 @@ type ResponseWriter struct {
 	AutoFlush bool // defaults to true, flushes buffered data on each Write.
 
 	wroteHeader bool
+	closed      bool
+	written     int64 // uncompressed bytes written.
+
+	// Required to re-negotiate the encoding on WriteHeader,
+	// see `WithContentLengthHint`.
+	config         *config
+	acceptEncoding []string
+	level          int  // the level as it was given.
+	encodingChosen bool // by the `WithEncodingChooser` or `WithUserAgentFilter`, it is not re-negotiated.
+
+	// The writer acquired from the pool, see `Close`.
+	pooledWriter Writer
+
+	// The response is buffered until its size reaches the streaming threshold,
+	// see `WithStreamingThreshold`.
+	buffering     bool
+	pending       *bytes.Buffer
+	pendingStatus int
+
+	// The compressed output is buffered until Close, see `WithFullBuffering`.
+	buffered *bufferedResponse
+	// Records the compressed response to be cached, see `WithResponseCache`.
+	recorder *cacheRecorder
+	// True when the cached response was sent, nothing else must be sent then.
+	servedFromCache bool
 }
 
 var _ http.ResponseWriter = (*ResponseWriter)(nil)
@@ -193,29 +527,147 @@ var _ http.ResponseWriter = (*ResponseWriter)(nil)
 //
 // See `Handler/WriteHandler` for its usage. In-short, the caller should
 // clear the writer through `defer Close()`.
-func NewResponseWriter(w http.ResponseWriter, r *http.Request, level int) (*ResponseWriter, error) {
-	encoding, err := GetEncoding(r, DefaultOffers)
+//
+// Optional "opts" can be passed to customize the negotiation, see `Option`.
+func NewResponseWriter(w http.ResponseWriter, r *http.Request, level int, opts ...Option) (*ResponseWriter, error) {
+	return newResponseWriter(w, r, level, newConfig(opts))
+}
+
+func newResponseWriter(w http.ResponseWriter, r *http.Request, level int, c *config) (*ResponseWriter, error) {
+	cw, err := newCompressResponseWriter(w, r, level, c)
+	acceptEncoding := acceptEncodingValues(r, c)
+	if len(acceptEncoding) > 0 {
+		h := w.Header()
+		if c.userAgentFilter != nil {
+			// The encoding depends on the User-Agent too, whether it was compressed or not.
+			addVary(h, AcceptEncodingHeaderKey)
+			addVary(h, UserAgentHeaderKey)
+		}
+
+		if c.forwardedAcceptEncodingKey != "" && len(r.Header[AcceptEncodingHeaderKey]) == 0 {
+			// The encoding depends on the forwarded header.
+			addVary(h, AcceptEncodingHeaderKey)
+			addVary(h, c.forwardedAcceptEncodingKey)
+		}
+	}
+
+	if err != nil && c.strictNegotiation && errors.Is(err, ErrNotSupportedCompression) &&
+		!identityAcceptable(acceptEncoding, c.maxAcceptSpecs) {
+		return nil, ErrNotAcceptable
+	}
+
+	if err != nil && c.identityFallback {
+		if errors.Is(err, ErrResponseNotCompressed) || errors.Is(err, ErrNotSupportedCompression) {
+			addVary(w.Header(), AcceptEncodingHeaderKey)
+			return NewIdentityResponseWriter(w), nil
+		}
+	}
+
+	return cw, err
+}
+
+// acceptEncodingValues returns the Accept-Encoding header values of the request or,
+// if they are missing, the ones of the forwarded header of a trusted proxy,
+// see `WithTrustedForwardedAcceptEncoding`, or the default encoding,
+// see `WithDefaultEncodingWhenAbsent`.
+func acceptEncodingValues(r *http.Request, c *config) []string {
+	values := r.Header[AcceptEncodingHeaderKey]
+	if len(values) > 0 || c == nil {
+		return values
+	}
+
+	if c.forwardedAcceptEncodingKey != "" && c.trustedProxy(r.RemoteAddr) {
+		if forwarded := r.Header.Values(c.forwardedAcceptEncodingKey); len(forwarded) > 0 {
+			// The first one is set by the proxy closest to the original client.
+			return forwarded[:1]
+		}
+	}
+
+	if c.defaultEncoding != "" {
+		return []string{c.defaultEncoding}
+	}
+
+	return nil
+}
+
+// NewIdentityResponseWriter wraps the "w" response writer and
+// returns a new response writer which writes the data as they are,
+// its Encoding field is "identity". The "Content-Encoding" header is not set.
+//
+// See `WithIdentityFallback` too.
+func NewIdentityResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	return &ResponseWriter{
+		ResponseWriter: w,
+		Level:          NoCompression,
+		Encoding:       IDENTITY,
+		Writer:         &identityWriter{w},
+		AutoFlush:      true,
+	}
+}
+
+func newCompressResponseWriter(w http.ResponseWriter, r *http.Request, level int, c *config) (*ResponseWriter, error) {
+	encoding, chosen, err := getEncoding(r, c.encodingOffers(), c)
 	if err != nil {
 		return nil, err
 	}
 
-	if level == -1 && encoding == BROTLI {
-		level = 6
+	var recorder *cacheRecorder
+	if c.responseCache != nil && r.Method == http.MethodGet {
+		recorder = &cacheRecorder{ResponseWriter: w, cache: c.responseCache, host: r.Host, path: r.URL.Path, query: r.URL.RawQuery}
+		w = recorder
 	}
 
-	cr, err := NewWriter(w, encoding, level)
+	if c.writeDeadline > 0 {
+		w = &deadlineResponseWriter{ResponseWriter: w, timeout: c.writeDeadline}
+	}
+
+	var (
+		cr              Writer
+		pooledWriter    Writer
+		normalizedLevel int
+		buffered        *bufferedResponse
+		output          io.Writer = w
+	)
+	if c.fullBufferingSize > 0 {
+		buffered = newBufferedResponse(w, c.fullBufferingSize)
+		output = buffered
+	}
+
+	if c.adaptiveLevel && (encoding == GZIP || encoding == DEFLATE) {
+		cr, err = NewAdaptiveWriter(output, encoding)
+		normalizedLevel = adaptiveLevels[adaptiveStartLevel]
+	} else {
+		normalizedLevel = normalizeLevel(encoding, level)
+		cr, err = acquireWriter(output, encoding, normalizedLevel, c.writer)
+		pooledWriter = cr
+	}
 	if err != nil {
+		if buffered != nil {
+			buffered.release()
+		}
 		return nil, err
 	}
 
-	AddCompressHeaders(w.Header(), encoding)
+	addCompressHeaders(w.Header(), c.contentEncodingHeaderKey, encoding)
 
 	v := &ResponseWriter{
 		ResponseWriter: w,
-		Level:          level,
+		Level:          normalizedLevel,
 		Encoding:       encoding,
 		Writer:         cr,
 		AutoFlush:      true,
+		config:         c,
+		acceptEncoding: acceptEncodingValues(r, c),
+		level:          level,
+		encodingChosen: chosen,
+		pooledWriter:   pooledWriter,
+		buffered:       buffered,
+		recorder:       recorder,
+	}
+
+	if c.streamingThreshold > 0 {
+		v.buffering = true
+		v.pending = acquireBuffer()
 	}
 
 	return v, nil
@@ -227,11 +679,16 @@ func (w *ResponseWriter) Write(p []byte) (int, error) {
 		h[ContentTypeHeaderKey] = []string{http.DetectContentType(p)}
 	}
 
+	if w.buffering {
+		return w.bufferWrite(p)
+	}
+
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
 	}
 
 	n, err := w.Writer.Write(p)
+	w.written += int64(n)
 	if err != nil {
 		return 0, err
 	}
@@ -247,23 +704,446 @@ func (w *ResponseWriter) Write(p []byte) (int, error) {
 // status code. Deletes the "Content-Length" response header and
 // calls the ResponseWriter's WriteHeader method.
 func (w *ResponseWriter) WriteHeader(statusCode int) {
+	if w.buffering {
+		w.bufferWriteHeader(statusCode)
+		return
+	}
+
 	if !w.wroteHeader {
 		w.wroteHeader = true
-		delete(w.Header(), ContentLengthHeaderKey)
+		if w.config != nil && w.config.contentLengthHint && w.Encoding != IDENTITY {
+			w.applyContentLengthHint()
+		}
+		if w.config != nil && w.config.s2UpgradeSize > 0 && w.Encoding == SNAPPY && !w.encodingChosen {
+			w.applyS2Upgrade()
+		}
+		if w.Encoding != IDENTITY {
+			delete(w.Header(), ContentLengthHeaderKey)
+		}
+		canonicalizeContentEncoding(w.Header(), w.contentEncodingHeaderKey())
+
+		if w.recorder != nil && w.serveCachedResponse(statusCode) {
+			return
+		}
+
+		if w.buffered != nil {
+			w.buffered.WriteHeader(statusCode)
+			return
+		}
+
+		w.ResponseWriter.WriteHeader(statusCode)
+	}
+}
+
+// output returns the writer the compressed data are written to.
+func (w *ResponseWriter) output() io.Writer {
+	if w.buffered != nil {
+		return w.buffered
+	}
+
+	return w.ResponseWriter
+}
+
+// dropBuffered stops the full buffering of the response, see `WithFullBuffering`.
+// Nothing must be written to the buffer yet.
+func (w *ResponseWriter) dropBuffered() {
+	if w.buffered != nil {
+		w.buffered.release()
+		w.buffered = nil
+	}
+}
+
+// ReadFrom reads data from "src" until EOF or error and writes them compressed.
+// It implements io.ReaderFrom, so io.Copy uses it.
+// When AutoFlush is false and the header was written,
+// the compressor's ReadFrom is used when it is available (e.g. s2 and snappy),
+// which avoids an intermediate copy. Otherwise, data are written
+// as through Write, flushed after each chunk when AutoFlush is true.
+func (w *ResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := w.Writer.(io.ReaderFrom); ok && !w.AutoFlush && w.wroteHeader {
+		n, err := rf.ReadFrom(src)
+		w.written += n
+		return n, err
+	}
+
+	return io.Copy(writerOnly{w}, src)
+}
+
+// writerOnly hides the ReadFrom method of a writer
+// so io.Copy does not call it recursively.
+type writerOnly struct {
+	io.Writer
+}
+
+// WritePrecompressed writes the "data", already compressed using the given "encoding",
+// as the response body, e.g. a cached brotli payload.
+// When the "encoding" is the response writer's one, the data are sent as they are,
+// along with their "Content-Length" if the header was not sent yet,
+// keeping the status code given to WriteHeader, if any.
+// Otherwise they are decompressed and written through the response writer's
+// encoding (transcoded), or as they are if it is the "identity" one.
+//
+// It should be called once, instead of Write, and the "Content-Type" should be set
+// by the caller as the data cannot be sniffed.
+// It does nothing when the response was served from the cache, see `WithResponseCache`.
+func (w *ResponseWriter) WritePrecompressed(encoding string, data []byte) error {
+	if w.servedFromCache {
+		return nil
+	}
+
+	if canonicalEncoding(encoding) != w.Encoding {
+		r, err := NewReader(bytes.NewReader(data), encoding)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		_, err = io.Copy(w, r)
+		return err
+	}
 
+	if w.written > 0 {
+		return errPrecompressedAfterWrite
+	}
+
+	statusCode, writeHeader := http.StatusOK, !w.wroteHeader
+	if w.buffering {
+		// Nothing to buffer, the data are sent as they are.
+		w.buffering = false
+		releaseBuffer(w.pending)
+		w.pending = nil
+		if w.pendingStatus != 0 {
+			statusCode = w.pendingStatus
+		}
+	}
+
+	if w.buffered != nil {
+		// The status code was recorded but not sent yet, see `WithFullBuffering`.
+		statusCode, writeHeader = w.buffered.statusCode, true
+		// The data are sent as they are, along with their own "Content-Length".
+		w.dropBuffered()
+	}
+
+	if writeHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		h.Set(ContentLengthHeaderKey, strconv.Itoa(len(data)))
+		canonicalizeContentEncoding(h, w.contentEncodingHeaderKey())
 		w.ResponseWriter.WriteHeader(statusCode)
 	}
+
+	// The compressor is not used at all, it must not write anything on Close either.
+	w.releasePooledWriter()
+	w.Writer = closedWriter{}
+
+	n, err := w.ResponseWriter.Write(data)
+	w.written += int64(n)
+	return err
+}
+
+var errPrecompressedAfterWrite = errors.New("compress: precompressed data after compressed data were written")
+
+// Unwrap returns the underlying response writer,
+// e.g. for the http.ResponseController of Go 1.20+.
+// Note that writing to it directly bypasses the compressor.
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeTimedOut reports whether a write or a flush to the client
+// exceeded the write deadline, see `WithWriteDeadline`.
+func (w *ResponseWriter) writeTimedOut() bool {
+	dw, ok := w.ResponseWriter.(*deadlineResponseWriter)
+	return ok && dw.timedOut
+}
+
+// contentEncodingHeaderKey returns the header key the encoding is declared at,
+// see `WithContentEncodingHeaderKey`.
+func (w *ResponseWriter) contentEncodingHeaderKey() string {
+	if w.config == nil {
+		return ContentEncodingHeaderKey
+	}
+
+	return w.config.contentEncodingHeaderKey
+}
+
+// Underlying returns the concrete compressor of the response writer,
+// see the package-level `Underlying` function.
+func (w *ResponseWriter) Underlying() interface{} {
+	return Underlying(w.Writer)
+}
+
+// String returns a debug representation of the response writer, e.g.
+// compress.ResponseWriter{encoding=gzip level=6 autoflush=true written=1234}.
+// The written value is the amount of uncompressed bytes written so far.
+func (w *ResponseWriter) String() string {
+	b := make([]byte, 0, 96)
+	b = append(b, "compress.ResponseWriter{encoding="...)
+	b = append(b, w.Encoding...)
+	b = append(b, " level="...)
+	b = strconv.AppendInt(b, int64(w.Level), 10)
+	b = append(b, " autoflush="...)
+	b = strconv.AppendBool(b, w.AutoFlush)
+	b = append(b, " written="...)
+	b = strconv.AppendInt(b, w.written, 10)
+	b = append(b, '}')
+	return string(b)
+}
+
+// Close finalizes the compressed body: it writes any buffered data
+// and the encoding's footer to the underlying response writer.
+// It should be called once the handler has finished writing,
+// and before the server emits the response trailers, if any,
+// so trailers declared through the "Trailer" header are always
+// sent after the end of the compressed body.
+// Calling Close more than once has no effect.
+func (w *ResponseWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if w.buffering {
+		// The threshold was not reached, the whole response is known, send it as it is.
+		if _, has := w.Header()[ContentLengthHeaderKey]; !has && w.pending.Len() > 0 {
+			w.Header().Set(ContentLengthHeaderKey, strconv.Itoa(w.pending.Len()))
+		}
+
+		if err := w.commitPending(false); err != nil {
+			return err
+		}
+	}
+
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	err := w.Writer.Close()
+	if err == nil && w.buffered != nil {
+		err = w.buffered.finish()
+	}
+	if w.recorder != nil {
+		if err == nil {
+			w.recorder.store()
+		}
+		w.abortResponseCache()
+	}
+	if err == nil && w.pooledWriter != nil && w.Writer == w.pooledWriter {
+		// The writer is returned to the pool strictly after its final flush:
+		// Close has written everything to the underlying response writer
+		// (and waited for any concurrent compression to finish).
+		// Any later write to this response writer must not reach it.
+		w.Writer = closedWriter{}
+		w.releasePooledWriter()
+	}
+
+	return err
+}
+
+// releasePooledWriter puts back the pooled writer, if any.
+// The writer must be unused or closed.
+func (w *ResponseWriter) releasePooledWriter() {
+	if w.pooledWriter == nil {
+		return
+	}
+
+	releaseWriter(w.pooledWriter, w.Encoding, w.Level, w.config.writer)
+	w.pooledWriter = nil
 }
 
 // Flush sends any buffered data to the client.
+// See `FlushError` to catch the flush errors.
 func (w *ResponseWriter) Flush() {
-	w.Writer.Flush()
+	_ = w.FlushError()
+}
 
-	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+// FlushError sends any buffered data to the client, like Flush does,
+// so the client can decode the response up to that point, and it returns the first error of the compressor or the underlying response writer,
+// e.g. to detect early that the client is gone.
+func (w *ResponseWriter) FlushError() error {
+	if w.buffering {
+		// The threshold was not reached, the data flushed so far are sent as they are.
+		if err := w.commitPending(false); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Writer.Flush(); err != nil {
+		return err
+	}
+
+	if w.buffered != nil && !w.buffered.streaming {
+		// The response is sent on Close.
+		return nil
+	}
+
+	return flushResponseWriter(w.ResponseWriter)
+}
+
+// flushResponseWriter flushes the "rw" if it supports flushing.
+func flushResponseWriter(rw http.ResponseWriter) error {
+	switch flusher := rw.(type) {
+	case interface{ FlushError() error }:
+		return flusher.FlushError()
+	case http.Flusher:
 		flusher.Flush()
 	}
+
+	return nil
+}
+
+// maxSizeReadCloser reads up to "remaining" bytes, see `WithMaxDecompressedSize`.
+type maxSizeReadCloser struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+	err       error
+}
+
+func (r *maxSizeReadCloser) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Read one more byte than the remaining ones
+	// to detect whether there are more data than the limit.
+	if int64(len(p))-1 > r.remaining {
+		p = p[:r.remaining+1]
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	if int64(n) <= r.remaining {
+		r.remaining -= int64(n)
+		r.err = err
+		return n, err
+	}
+
+	n = int(r.remaining)
+	r.remaining = 0
+	r.err = &BodyTooLargeError{Limit: r.limit, Err: ErrDecompressedBodyTooLarge}
+	return n, r.err
 }
 
+// closedWriter is the Writer of a closed response writer.
+type closedWriter struct{}
+
+var _ Writer = closedWriter{}
+
+func (closedWriter) Write([]byte) (int, error) { return 0, io.ErrClosedPipe }
+func (closedWriter) Flush() error              { return nil }
+func (closedWriter) Close() error              { return nil }
+func (closedWriter) Reset(io.Writer)           {}
+
+// discardWriter is the Writer of a response served from the cache,
+// see `WithResponseCache`. It discards the data the handler writes.
+type discardWriter struct{}
+
+var _ Writer = discardWriter{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (discardWriter) Flush() error                { return nil }
+func (discardWriter) Close() error                { return nil }
+func (discardWriter) Reset(io.Writer)             {}
+
+// reproducibleGzipWriter is a gzip Writer which writes a fixed header,
+// see `WithReproducibleGzip`. Reset clears the gzip header, so it is set again.
+type reproducibleGzipWriter struct {
+	*gzip.Writer
+}
+
+func (w *reproducibleGzipWriter) Reset(dst io.Writer) {
+	w.Writer.Reset(dst)
+	w.setHeader()
+}
+
+func (w *reproducibleGzipWriter) Underlying() interface{} {
+	return w.Writer
+}
+
+func (w *reproducibleGzipWriter) setHeader() {
+	// A zero MTIME means no timestamp is available, see RFC 1952.
+	w.Header.ModTime = time.Unix(0, 0)
+	w.Header.OS = 255 // unknown.
+}
+
+// seekableReadCloser is a decompressed body buffered in memory, see `WithSeekableBody`.
+type seekableReadCloser struct {
+	*bytes.Reader
+	io.Closer
+}
+
+// newSeekableReadCloser reads the whole "rc" into memory and returns a seekable reader of it.
+// If the data are larger than "maxBuffer" bytes, it returns a reader
+// of the buffered data followed by the rest of "rc", which is not seekable.
+func newSeekableReadCloser(rc io.ReadCloser, maxBuffer int) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(rc, int64(maxBuffer)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if n > int64(maxBuffer) {
+		return &readCloser{Reader: io.MultiReader(&buf, rc), Closer: rc}, nil
+	}
+
+	return &seekableReadCloser{Reader: bytes.NewReader(buf.Bytes()), Closer: rc}, nil
+}
+
+// countReader counts the bytes read from the underlying Reader.
+type countReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// countByteReader is a countReader of an io.ByteReader source.
+type countByteReader struct {
+	*countReader
+	br io.ByteReader
+}
+
+func (r *countByteReader) ReadByte() (byte, error) {
+	b, err := r.br.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return b, err
+}
+
+// readAheadLimitReader reads at most n bytes from the underlying reader on each Read call.
+type readAheadLimitReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *readAheadLimitReader) Read(p []byte) (int, error) {
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+
+	return r.r.Read(p)
+}
+
+// identityWriter is the Writer of the "identity" encoding,
+// it writes the data as they are.
+type identityWriter struct {
+	io.Writer
+}
+
+var _ Writer = (*identityWriter)(nil)
+
+func (w *identityWriter) Flush() error        { return nil }
+func (w *identityWriter) Close() error        { return nil }
+func (w *identityWriter) Reset(dst io.Writer) { w.Writer = dst }
+
 type (
 	noOpWriter struct{}
 
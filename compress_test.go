@@ -0,0 +1,856 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+)
+
+// testBody is a compressible response body.
+var testBody = strings.Repeat("Hello, compressed world! ", 200)
+
+func writeTestBody(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, testBody)
+}
+
+// newTestRequest returns a GET request of "/" which accepts the given encodings.
+func newTestRequest(acceptEncoding string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if acceptEncoding != "" {
+		r.Header.Set(AcceptEncodingHeaderKey, acceptEncoding)
+	}
+
+	return r
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// testHandler writes its body as the response,
+// in writes of up to "chunkSize" bytes or all at once if it is zero.
+type testHandler struct {
+	body string
+	// contentLength sets the "Content-Length" header before the first write.
+	contentLength bool
+	chunkSize     int
+	// flush flushes the response after each write.
+	flush bool
+}
+
+func (h testHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.contentLength {
+		w.Header().Set(ContentLengthHeaderKey, strconv.Itoa(len(h.body)))
+	}
+
+	for rest := h.body; len(rest) > 0; {
+		n := len(rest)
+		if h.chunkSize > 0 && h.chunkSize < n {
+			n = h.chunkSize
+		}
+		io.WriteString(w, rest[:n])
+		rest = rest[n:]
+
+		if h.flush {
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// decompress returns the decompressed "data" of the given "encoding",
+// or the "data" as they are if the encoding is empty.
+func decompress(t testing.TB, encoding string, data []byte) []byte {
+	t.Helper()
+
+	if encoding == "" || encoding == IDENTITY {
+		return data
+	}
+
+	r, err := NewReader(bytes.NewReader(data), encoding)
+	if err != nil {
+		t.Fatalf("%s: new reader: %v", encoding, err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: read: %v", encoding, err)
+	}
+
+	return b
+}
+
+// expectResponse fails the test if the recorded response is not encoded
+// using the "encoding" or its decoded body is not the "body".
+func expectResponse(t testing.TB, rec *httptest.ResponseRecorder, encoding, body string) {
+	t.Helper()
+
+	if got := rec.Header().Get(ContentEncodingHeaderKey); got != encoding {
+		t.Fatalf("expected encoding %q but got %q", encoding, got)
+	}
+
+	if got := decompress(t, encoding, rec.Body.Bytes()); string(got) != body {
+		t.Fatalf("expected body of %d bytes but got %d bytes: %q", len(body), len(got), got)
+	}
+}
+
+func TestEncodingChooser(t *testing.T) {
+	var candidates []string
+	h := WriteHandler(http.HandlerFunc(writeTestBody), WithEncodingChooser(func(r *http.Request, c []string) string {
+		candidates = c
+		return c[len(c)-1]
+	}))
+
+	rec := serve(h, newTestRequest("gzip, deflate, br"))
+	if expected := []string{GZIP, DEFLATE, BROTLI}; !reflect.DeepEqual(candidates, expected) {
+		t.Fatalf("expected candidates %v but got %v", expected, candidates)
+	}
+	expectResponse(t, rec, BROTLI, testBody)
+}
+
+func TestEncodingChooserInvalidChoice(t *testing.T) {
+	h := WriteHandler(http.HandlerFunc(writeTestBody), WithEncodingChooser(func(r *http.Request, c []string) string {
+		return "zstd"
+	}))
+
+	rec := serve(h, newTestRequest("deflate;q=0.5, gzip"))
+	expectResponse(t, rec, GZIP, testBody)
+}
+
+func TestHuffmanOnly(t *testing.T) {
+	for _, encoding := range []string{GZIP, DEFLATE, BROTLI} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, encoding, HuffmanOnly)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if _, err = io.WriteString(w, testBody); err != nil {
+			t.Fatalf("%s: write: %v", encoding, err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatalf("%s: close: %v", encoding, err)
+		}
+
+		if got := decompress(t, encoding, buf.Bytes()); string(got) != testBody {
+			t.Fatalf("%s: expected the original data but got %q", encoding, got)
+		}
+	}
+}
+
+func TestNormalizeLevel(t *testing.T) {
+	tests := []struct {
+		encoding string
+		level    int
+		expected int
+	}{
+		{GZIP, HuffmanOnly, HuffmanOnly},
+		{DEFLATE, HuffmanOnly, HuffmanOnly},
+		{GZIP, DefaultCompression, DefaultCompression},
+		{GZIP, 9, 9},
+		{BROTLI, DefaultCompression, 6},
+		// Brotli has no Huffman-only strategy, it must not be mapped to its default level.
+		{BROTLI, HuffmanOnly, 0},
+		{BROTLI, 11, 11},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeLevel(tt.encoding, tt.level); got != tt.expected {
+			t.Errorf("%s@%d: expected level %d but got %d", tt.encoding, tt.level, tt.expected, got)
+		}
+	}
+}
+
+func TestHuffmanOnlyResponseWriter(t *testing.T) {
+	h := WriteHandler(http.HandlerFunc(writeTestBody), WithLevel(HuffmanOnly))
+
+	for _, encoding := range []string{GZIP, DEFLATE, BROTLI} {
+		rec := serve(h, newTestRequest(encoding))
+		expectResponse(t, rec, encoding, testBody)
+	}
+}
+
+func TestTrailerAfterCompressedBody(t *testing.T) {
+	const trailerKey = "X-Checksum"
+
+	srv := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", trailerKey)
+		writeTestBody(w, r)
+		w.(http.Flusher).Flush()
+		w.Header().Set(trailerKey, "42")
+	})))
+	defer srv.Close()
+
+	for _, encoding := range []string{GZIP, DEFLATE, BROTLI, SNAPPY} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(AcceptEncodingHeaderKey, encoding)
+
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: read: %v", encoding, err)
+		}
+
+		if got := resp.Header.Get(ContentEncodingHeaderKey); got != encoding {
+			t.Fatalf("expected encoding %q but got %q", encoding, got)
+		}
+		if got := decompress(t, encoding, body); string(got) != testBody {
+			t.Fatalf("%s: expected the original body but got %q", encoding, got)
+		}
+		// The trailers are read after the whole body.
+		if got := resp.Trailer.Get(trailerKey); got != "42" {
+			t.Fatalf("%s: expected trailer value %q but got %q", encoding, "42", got)
+		}
+	}
+}
+
+func TestIdentityFallback(t *testing.T) {
+	for _, acceptEncoding := range []string{"", "zstd"} {
+		rec := httptest.NewRecorder()
+		w, err := NewResponseWriter(rec, newTestRequest(acceptEncoding), DefaultCompression, WithIdentityFallback())
+		if err != nil {
+			t.Fatalf("%q: %v", acceptEncoding, err)
+		}
+
+		if w.Encoding != IDENTITY {
+			t.Fatalf("%q: expected encoding %q but got %q", acceptEncoding, IDENTITY, w.Encoding)
+		}
+
+		io.WriteString(w, testBody)
+		if err = w.Close(); err != nil {
+			t.Fatalf("%q: close: %v", acceptEncoding, err)
+		}
+
+		expected := "compress.ResponseWriter{encoding=identity level=0 autoflush=true written=" + strconv.Itoa(len(testBody)) + "}"
+		if got := w.String(); got != expected {
+			t.Fatalf("%q: expected %s but got %s", acceptEncoding, expected, got)
+		}
+		expectResponse(t, rec, "", testBody)
+	}
+}
+
+func TestIdentityFallbackDisabled(t *testing.T) {
+	_, err := NewResponseWriter(httptest.NewRecorder(), newTestRequest(""), DefaultCompression)
+	if !errors.Is(err, ErrResponseNotCompressed) {
+		t.Fatalf("expected ErrResponseNotCompressed but got %v", err)
+	}
+}
+
+// limitedSource records the largest read and the bytes read from a reader.
+type limitedSource struct {
+	r       io.Reader
+	n       int64
+	maxRead int
+}
+
+func (s *limitedSource) Read(p []byte) (int, error) {
+	if len(p) > s.maxRead {
+		s.maxRead = len(p)
+	}
+
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	return n, err
+}
+
+func TestReadAheadLimit(t *testing.T) {
+	const limit = 1024
+
+	// Incompressible data, so the compressed and the decompressed offsets are close.
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// The decoders keep a window (or a block) of decompressed data,
+	// see `WithReadAheadLimit`, the source is never read further ahead.
+	tests := []struct {
+		encoding string
+		buffered int64
+	}{
+		{GZIP, maxDeflateWindow},
+		{DEFLATE, maxDeflateWindow},
+		{BROTLI, maxDeflateWindow},
+		{SNAPPY, 64 << 10},
+	}
+
+	for _, tt := range tests {
+		src := &limitedSource{r: bytes.NewReader(compressData(t, tt.encoding, data))}
+		r, err := NewReader(src, tt.encoding, WithReadAheadLimit(limit))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.encoding, err)
+		}
+
+		// A throttled consumer, e.g. a slow client.
+		var (
+			consumed int64
+			p        = make([]byte, 512)
+		)
+		for {
+			n, err := r.Read(p)
+			consumed += int64(n)
+			if ahead := src.n - consumed; ahead > tt.buffered+2*limit {
+				t.Fatalf("%s: the source was read %d bytes ahead of the consumer", tt.encoding, ahead)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: read: %v", tt.encoding, err)
+			}
+		}
+
+		if consumed != int64(len(data)) {
+			t.Fatalf("%s: expected %d bytes but read %d", tt.encoding, len(data), consumed)
+		}
+		if src.maxRead > limit {
+			t.Fatalf("%s: expected source reads of %d bytes at most but got %d", tt.encoding, limit, src.maxRead)
+		}
+	}
+}
+
+func TestResponseWriterString(t *testing.T) {
+	w, err := NewResponseWriter(httptest.NewRecorder(), newTestRequest(GZIP), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	expected := "compress.ResponseWriter{encoding=gzip level=6 autoflush=true written=0}"
+	if got := w.String(); got != expected {
+		t.Fatalf("expected %s but got %s", expected, got)
+	}
+
+	w.AutoFlush = false
+	io.WriteString(w, "1234")
+	expected = "compress.ResponseWriter{encoding=gzip level=6 autoflush=false written=4}"
+	if got := fmt.Sprintf("%v", w); got != expected {
+		t.Fatalf("expected %s but got %s", expected, got)
+	}
+}
+
+func TestReaderString(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(compressData(t, BROTLI, []byte(testBody))), "BR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	expected := "compress.Reader{encoding=br}"
+	if got := r.String(); got != expected {
+		t.Fatalf("expected %s but got %s", expected, got)
+	}
+}
+
+func TestCanonicalContentEncoding(t *testing.T) {
+	h := make(http.Header)
+	AddCompressHeaders(h, "GZIP")
+	if got := h.Get(ContentEncodingHeaderKey); got != GZIP {
+		t.Fatalf("expected encoding %q but got %q", GZIP, got)
+	}
+
+	AddCompressHeaders(h, "X-Custom")
+	if got := h.Get(ContentEncodingHeaderKey); got != "X-Custom" {
+		t.Fatalf("expected the unknown encoding to be kept but got %q", got)
+	}
+
+	for _, acceptEncoding := range []string{"GZIP", "Br", "Deflate;q=0.5"} {
+		rec := serve(WriteHandler(http.HandlerFunc(writeTestBody)), newTestRequest(acceptEncoding))
+		if got := rec.Header().Get(ContentEncodingHeaderKey); got != strings.ToLower(got) {
+			t.Fatalf("%q: expected a lowercase encoding but got %q", acceptEncoding, got)
+		}
+	}
+}
+
+func TestCanonicalContentEncodingPassThrough(t *testing.T) {
+	tests := []struct {
+		upstream string
+		expected string
+	}{
+		{"GZIP", GZIP},
+		{"BR", BROTLI},
+		{"X-Unknown", "X-Unknown"},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		w := NewIdentityResponseWriter(rec)
+		// A proxy which passes the upstream's, already compressed, body through.
+		w.Header().Set(ContentEncodingHeaderKey, tt.upstream)
+		w.WriteHeader(http.StatusOK)
+
+		if got := rec.Header().Get(ContentEncodingHeaderKey); got != tt.expected {
+			t.Fatalf("expected encoding %q but got %q", tt.expected, got)
+		}
+	}
+}
+
+var errBrokenPipe = errors.New("broken pipe")
+
+// failingResponseWriter fails its writes, and its flushes, once failing is set.
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+	failing bool
+}
+
+func (w *failingResponseWriter) Write(p []byte) (int, error) {
+	if w.failing {
+		return 0, errBrokenPipe
+	}
+
+	return w.ResponseRecorder.Write(p)
+}
+
+func (w *failingResponseWriter) FlushError() error {
+	if w.failing {
+		return errBrokenPipe
+	}
+
+	w.ResponseRecorder.Flush()
+	return nil
+}
+
+func TestFlushError(t *testing.T) {
+	for _, encoding := range []string{GZIP, BROTLI, SNAPPY} {
+		rw := &failingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+		w, err := NewResponseWriter(rw, newTestRequest(encoding), DefaultCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.AutoFlush = false
+
+		io.WriteString(w, testBody)
+		if err = w.FlushError(); err != nil {
+			t.Fatalf("%s: expected no flush error but got %v", encoding, err)
+		}
+
+		// The compressor's data cannot be written.
+		rw.failing = true
+		io.WriteString(w, testBody)
+		if err = w.FlushError(); !errors.Is(err, errBrokenPipe) {
+			t.Fatalf("%s: expected the underlying write error but got %v", encoding, err)
+		}
+
+		// A later flush fails too.
+		if err = w.FlushError(); !errors.Is(err, errBrokenPipe) {
+			t.Fatalf("%s: expected the flush error again but got %v", encoding, err)
+		}
+	}
+}
+
+func TestWritePrecompressed(t *testing.T) {
+	cached := compressData(t, BROTLI, []byte(testBody))
+
+	h := WriteHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ContentTypeHeaderKey, "text/plain; charset=utf-8")
+		if err := w.(*ResponseWriter).WritePrecompressed(BROTLI, cached); err != nil {
+			t.Errorf("write precompressed: %v", err)
+		}
+	}))
+
+	// Passthrough.
+	rec := serve(h, newTestRequest("br"))
+	expectResponse(t, rec, BROTLI, testBody)
+	if !bytes.Equal(rec.Body.Bytes(), cached) {
+		t.Fatal("expected the precompressed data to be sent as they are")
+	}
+	if got, expected := rec.Header().Get(ContentLengthHeaderKey), strconv.Itoa(len(cached)); got != expected {
+		t.Fatalf("expected Content-Length %s but got %s", expected, got)
+	}
+
+	// Transcode.
+	for _, encoding := range []string{GZIP, SNAPPY} {
+		rec = serve(h, newTestRequest(encoding))
+		expectResponse(t, rec, encoding, testBody)
+		if got := rec.Header().Get(ContentLengthHeaderKey); got != "" {
+			t.Fatalf("%s: expected no Content-Length but got %s", encoding, got)
+		}
+	}
+}
+
+func TestWritePrecompressedStatusCode(t *testing.T) {
+	cached := compressData(t, GZIP, []byte(testBody))
+
+	for name, opt := range map[string]Option{
+		"full buffering":      WithFullBuffering(4096),
+		"streaming threshold": WithStreamingThreshold(1000),
+	} {
+		h := WriteHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			if err := w.(*ResponseWriter).WritePrecompressed(GZIP, cached); err != nil {
+				t.Errorf("%s: write precompressed: %v", name, err)
+			}
+		}), opt)
+
+		rec := serve(h, newTestRequest(GZIP))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("%s: expected status code %d but got %d", name, http.StatusCreated, rec.Code)
+		}
+		expectResponse(t, rec, GZIP, testBody)
+		if got, expected := rec.Header().Get(ContentLengthHeaderKey), strconv.Itoa(len(cached)); got != expected {
+			t.Fatalf("%s: expected Content-Length %s but got %s", name, expected, got)
+		}
+	}
+}
+
+func TestWritePrecompressedAfterWrite(t *testing.T) {
+	w, err := NewResponseWriter(httptest.NewRecorder(), newTestRequest(GZIP), DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	io.WriteString(w, testBody)
+	if err = w.WritePrecompressed(GZIP, compressData(t, GZIP, []byte(testBody))); err == nil {
+		t.Fatal("expected an error when precompressed data follow compressed data")
+	}
+}
+
+// htmlBody returns an HTML document whose rows repeat at a distance
+// larger than the smallest brotli window.
+func htmlBody() string {
+	rnd := rand.New(rand.NewSource(1))
+
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html><html><body><table>\n")
+	var rows []string
+	for i := 0; i < 200; i++ {
+		rows = append(rows, fmt.Sprintf("<tr><td class=\"id\">%d</td><td>%x</td></tr>\n", rnd.Int63(), rnd.Int63()))
+	}
+	for i := 0; i < 20; i++ {
+		for _, row := range rows {
+			b.WriteString(row)
+		}
+	}
+	b.WriteString("</table></body></html>\n")
+
+	return b.String()
+}
+
+func TestBrotliWindow(t *testing.T) {
+	data := htmlBody()
+
+	compress := func(opts ...Option) []byte {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, BROTLI, DefaultCompression, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.WriteString(w, data); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := decompress(t, BROTLI, buf.Bytes()); string(got) != data {
+			t.Fatal("expected the data to be decompressed as they are")
+		}
+		return buf.Bytes()
+	}
+
+	small, large := compress(WithBrotliWindow(10)), compress(WithBrotliWindow(22))
+	// The rows repeat every ~10KB, the 1KB window cannot reference them.
+	if len(small) < 2*len(large) {
+		t.Fatalf("expected the 1KB window to compress worse than the 4MB one but got %d and %d bytes", len(small), len(large))
+	}
+
+	// The option applies to the response writers too.
+	h := WriteHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ContentTypeHeaderKey, "text/html; charset=utf-8")
+		io.WriteString(w, data)
+	}), WithBrotliWindow(10))
+	rec := serve(h, newTestRequest(BROTLI))
+	expectResponse(t, rec, BROTLI, data)
+	if rec.Body.Len() < 2*len(large) {
+		t.Fatalf("expected the response body to be compressed using the 1KB window but got %d bytes", rec.Body.Len())
+	}
+}
+
+func TestUnderlying(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := NewWriter(&buf, GZIP, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, ok := Underlying(w).(*gzip.Writer)
+	if !ok {
+		t.Fatalf("expected a *gzip.Writer but got %T", Underlying(w))
+	}
+	gw.Name = "data.txt" // a library-specific field.
+
+	if w, err = NewWriter(&buf, GZIP, -1, WithReproducibleGzip()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = Underlying(w).(*gzip.Writer); !ok {
+		t.Fatalf("expected the reproducible writer to unwrap to a *gzip.Writer but got %T", Underlying(w))
+	}
+
+	if w, err = NewWriter(&buf, BROTLI, -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = Underlying(w).(*brotli.Writer); !ok {
+		t.Fatalf("expected a *brotli.Writer but got %T", Underlying(w))
+	}
+
+	if w, err = NewAdaptiveWriter(&buf, DEFLATE); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = Underlying(w).(*flate.Writer); !ok {
+		t.Fatalf("expected the adaptive writer to unwrap to a *flate.Writer but got %T", Underlying(w))
+	}
+}
+
+func TestReproducibleGzip(t *testing.T) {
+	h := WriteHandler(http.HandlerFunc(writeTestBody), WithReproducibleGzip())
+
+	first := serve(h, newTestRequest(GZIP))
+	expectResponse(t, first, GZIP, testBody)
+	second := serve(h, newTestRequest(GZIP))
+	expectResponse(t, second, GZIP, testBody)
+	if !bytes.Equal(first.Body.Bytes(), second.Body.Bytes()) {
+		t.Fatalf("expected byte-identical responses but got %x and %x", first.Body.Bytes(), second.Body.Bytes())
+	}
+
+	// A pooled writer is Reset before its next response, the header must be kept.
+	var fresh, reset bytes.Buffer
+	w, err := NewWriter(&fresh, GZIP, DefaultCompression, WithReproducibleGzip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, testBody)
+	w.Close()
+
+	w.Reset(&reset)
+	io.WriteString(w, testBody)
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fresh.Bytes(), reset.Bytes()) {
+		t.Fatalf("expected byte-identical output after reset but got %x and %x", fresh.Bytes(), reset.Bytes())
+	}
+}
+
+func TestUserAgentFilter(t *testing.T) {
+	h := WriteHandler(http.HandlerFunc(writeTestBody), WithUserAgentFilter(func(ua string) (bool, string) {
+		switch {
+		case strings.HasPrefix(ua, "LegacyBot/"):
+			return false, ""
+		case strings.HasPrefix(ua, "LegacyProxy/"):
+			return true, GZIP
+		default:
+			return true, ""
+		}
+	}))
+
+	tests := []struct {
+		userAgent string
+		encoding  string
+	}{
+		{"LegacyBot/1.0", ""},
+		{"LegacyProxy/2.1", GZIP},
+		{"Mozilla/5.0", BROTLI},
+		{"", BROTLI},
+	}
+
+	for _, tt := range tests {
+		r := newTestRequest("gzip;q=0.5, br")
+		r.Header.Set("User-Agent", tt.userAgent)
+		expectResponse(t, serve(h, r), tt.encoding, testBody)
+	}
+}
+
+func TestReaderBytesRead(t *testing.T) {
+	for _, encoding := range []string{GZIP, DEFLATE, BROTLI, SNAPPY} {
+		compressed, err := Compress(encoding, DefaultCompression, []byte(testBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := NewReader(bytes.NewReader(compressed), encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := make([]byte, 10)
+		if _, err = io.ReadFull(r, p); err != nil {
+			t.Fatal(err)
+		}
+		if got := r.DecompressedBytesRead(); got != int64(len(p)) {
+			t.Fatalf("%s: expected %d decompressed bytes read so far but got %d", encoding, len(p), got)
+		}
+
+		if _, err = io.Copy(io.Discard, r); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+
+		if got := r.CompressedBytesRead(); got != int64(len(compressed)) {
+			t.Fatalf("%s: expected %d compressed bytes read but got %d", encoding, len(compressed), got)
+		}
+		if got := r.DecompressedBytesRead(); got != int64(len(testBody)) {
+			t.Fatalf("%s: expected %d decompressed bytes read but got %d", encoding, len(testBody), got)
+		}
+	}
+}
+
+func TestUserAgentFilterVary(t *testing.T) {
+	filter := WithUserAgentFilter(func(ua string) (bool, string) {
+		return !strings.HasPrefix(ua, "LegacyBot/"), ""
+	})
+
+	tests := []struct {
+		userAgent string
+		opts      []Option
+		encoding  string
+		vary      string
+	}{
+		{"LegacyBot/1.0", []Option{filter}, "", "Accept-Encoding, User-Agent"},
+		{"Mozilla/5.0", []Option{filter}, GZIP, "Accept-Encoding, User-Agent"},
+		{"LegacyBot/1.0", nil, GZIP, "Accept-Encoding"},
+	}
+
+	for _, tt := range tests {
+		h := WriteHandler(http.HandlerFunc(writeTestBody), tt.opts...)
+		r := newTestRequest(GZIP)
+		r.Header.Set(UserAgentHeaderKey, tt.userAgent)
+		rec := serve(h, r)
+
+		expectResponse(t, rec, tt.encoding, testBody)
+		if got := strings.Join(rec.Header().Values(VaryHeaderKey), ", "); got != tt.vary {
+			t.Fatalf("%s: expected Vary: %s but got %s", tt.userAgent, tt.vary, got)
+		}
+	}
+}
+
+func TestFlushDecodablePrefix(t *testing.T) {
+	lines := []string{"first log line\n", "second log line\n"}
+
+	for _, encoding := range []string{GZIP, DEFLATE, BROTLI, SNAPPY, S2} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, encoding, DefaultCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var r *Reader
+		for _, line := range lines {
+			if _, err = io.WriteString(w, line); err != nil {
+				t.Fatal(err)
+			}
+			if err = w.Flush(); err != nil {
+				t.Fatalf("%s: flush: %v", encoding, err)
+			}
+
+			// The client reads the data flushed so far, before Close.
+			if r == nil {
+				if r, err = NewReader(&buf, encoding); err != nil {
+					t.Fatalf("%s: new reader: %v", encoding, err)
+				}
+			}
+			p := make([]byte, len(line))
+			if _, err = io.ReadFull(r, p); err != nil {
+				t.Fatalf("%s: expected the flushed line to be decoded before close but got %v", encoding, err)
+			}
+			if string(p) != line {
+				t.Fatalf("%s: expected %q but got %q", encoding, line, p)
+			}
+		}
+
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if rest, err := io.ReadAll(r); err != nil || len(rest) != 0 {
+			t.Fatalf("%s: expected the stream to end after close but got %q: %v", encoding, rest, err)
+		}
+	}
+}
+
+func TestSeekableBody(t *testing.T) {
+	compressed := compressData(t, GZIP, []byte(testBody))
+
+	r, err := NewReader(bytes.NewReader(compressed), GZIP, WithSeekableBody(len(testBody)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := r.Seekable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		b, err := io.ReadAll(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != testBody {
+			t.Fatalf("[%d] expected the decompressed body but got %q", i, b)
+		}
+
+		if pos, err := sr.Seek(0, io.SeekStart); err != nil || pos != 0 {
+			t.Fatalf("[%d] expected to seek to 0 but got %d: %v", i, pos, err)
+		}
+	}
+
+	// The data read again are not counted twice.
+	if n := sr.DecompressedBytesRead(); n != int64(len(testBody)) {
+		t.Fatalf("expected %d decompressed bytes read but got %d", len(testBody), n)
+	}
+
+	// Beyond the cap the body is still read, once.
+	if r, err = NewReader(bytes.NewReader(compressed), GZIP, WithSeekableBody(len(testBody)-1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Seekable(); !errors.Is(err, ErrBodyNotSeekable) {
+		t.Fatalf("expected ErrBodyNotSeekable but got %v", err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil || string(b) != testBody {
+		t.Fatalf("expected the decompressed body but got %q: %v", b, err)
+	}
+
+	// Through the ReadHandler, for frameworks which rewind the body.
+	h := ReadHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first, _ := io.ReadAll(r.Body)
+		if _, err := r.Body.(io.Seeker).Seek(0, io.SeekStart); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		second, _ := io.ReadAll(r.Body)
+		w.Write(first)
+		w.Write(second)
+	}), WithSeekableBody(1<<20))
+
+	rec := serve(h, newUploadRequest(GZIP, compressed))
+	if rec.Code != http.StatusOK || rec.Body.String() != testBody+testBody {
+		t.Fatalf("expected the body to be read twice but got %d: %q", rec.Code, rec.Body.String())
+	}
+
+	// Beyond the cap the request body is not an io.Seeker.
+	h = ReadHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Body.(io.Seeker); ok {
+			t.Errorf("expected a body which is not an io.Seeker but got %T", r.Body)
+		}
+	}), WithSeekableBody(len(testBody)-1))
+	serve(h, newUploadRequest(GZIP, compressed))
+}
@@ -0,0 +1,81 @@
+// Package compresstest provides utilities for testing handlers
+// wrapped by the compress middlewares.
+package compresstest
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kataras/compress"
+)
+
+// Response is a recorded response of `DoRequest`.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	// Encoding is the response's "Content-Encoding" header value,
+	// empty if the response was not compressed.
+	Encoding string
+	// Body is the decoded response body.
+	Body []byte
+	// CompressedLength is the length of the response body as it was sent.
+	CompressedLength int
+}
+
+// DoRequest serves a request of "method", "path" and "body" (can be nil)
+// through the "handler", with its "Accept-Encoding" header set to "encoding",
+// and returns the recorded response with its body decoded.
+// An empty "encoding" sends no "Accept-Encoding" header.
+//
+// It returns an error if the response body cannot be decoded using its "Content-Encoding".
+func DoRequest(handler http.Handler, method, path string, body io.Reader, encoding string) (*Response, error) {
+	req := httptest.NewRequest(method, path, body)
+	if encoding != "" {
+		req.Header.Set(compress.AcceptEncodingHeaderKey, encoding)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	resp := &Response{
+		StatusCode:       rec.Code,
+		Header:           rec.Header(),
+		Encoding:         rec.Header().Get(compress.ContentEncodingHeaderKey),
+		CompressedLength: rec.Body.Len(),
+	}
+
+	r, err := compress.NewReader(rec.Body, resp.Encoding)
+	if err != nil {
+		if !errors.Is(err, compress.ErrRequestNotCompressed) {
+			return nil, err
+		}
+
+		resp.Body = rec.Body.Bytes()
+		return resp, nil
+	}
+	defer r.Close()
+
+	if resp.Body, err = io.ReadAll(r); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// AssertEncoding reports an error through "t" if the response
+// was not encoded using the "expected" encoding.
+// Use an empty "expected" value, or "identity", to assert an uncompressed response.
+func AssertEncoding(t testing.TB, resp *Response, expected string) {
+	t.Helper()
+
+	if expected == compress.IDENTITY {
+		expected = ""
+	}
+
+	if resp.Encoding != expected {
+		t.Errorf("compresstest: expected encoding %q but got %q", expected, resp.Encoding)
+	}
+}
@@ -0,0 +1,104 @@
+package compresstest_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/kataras/compress"
+	"github.com/kataras/compress/compresstest"
+)
+
+type payload struct {
+	Data string `json:"data"`
+}
+
+// readWrite is the handler of the _examples/http example.
+func readWrite(w http.ResponseWriter, r *http.Request) {
+	var p payload
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	fmt.Fprintf(w, "Data received: %s", p.Data)
+}
+
+func newExampleHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readwrite", readWrite)
+	return compress.Handler(mux)
+}
+
+func TestDoRequest(t *testing.T) {
+	h := newExampleHandler()
+
+	for _, encoding := range []string{compress.GZIP, compress.DEFLATE, compress.BROTLI, compress.SNAPPY, ""} {
+		resp, err := compresstest.DoRequest(h, http.MethodPost, "/readwrite", strings.NewReader(`{"data":"hello"}`), encoding)
+		if err != nil {
+			t.Fatalf("%q: %v", encoding, err)
+		}
+
+		compresstest.AssertEncoding(t, resp, encoding)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%q: expected status code %d but got %d", encoding, http.StatusOK, resp.StatusCode)
+		}
+		if expected := "Data received: hello"; string(resp.Body) != expected {
+			t.Fatalf("%q: expected body %q but got %q", encoding, expected, resp.Body)
+		}
+		if encoding == "" && resp.CompressedLength != len(resp.Body) {
+			t.Fatalf("expected the uncompressed length %d but got %d", len(resp.Body), resp.CompressedLength)
+		}
+	}
+
+	resp, err := compresstest.DoRequest(h, http.MethodPost, "/readwrite", strings.NewReader("invalid"), compress.GZIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compresstest.AssertEncoding(t, resp, compress.GZIP)
+	if resp.StatusCode != http.StatusBadRequest || string(resp.Body) != http.StatusText(http.StatusBadRequest) {
+		t.Fatalf("expected a decoded 400 response but got %d: %q", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestDoRequestInvalidBody(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(compress.ContentEncodingHeaderKey, compress.GZIP)
+		w.Write([]byte("not a gzip stream"))
+	})
+
+	if _, err := compresstest.DoRequest(h, http.MethodGet, "/", nil, compress.GZIP); err == nil {
+		t.Fatal("expected an error on a body which cannot be decoded")
+	}
+}
+
+// recordingTB records the errors reported through it.
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recordingTB) Helper() {}
+
+func (t *recordingTB) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertEncoding(t *testing.T) {
+	resp := &compresstest.Response{Encoding: ""}
+
+	rt := &recordingTB{TB: t}
+	compresstest.AssertEncoding(rt, resp, compress.IDENTITY)
+	compresstest.AssertEncoding(rt, resp, "")
+	if len(rt.errors) != 0 {
+		t.Fatalf("expected no errors but got %q", rt.errors)
+	}
+
+	compresstest.AssertEncoding(rt, resp, compress.GZIP)
+	if len(rt.errors) != 1 {
+		t.Fatalf("expected an error on an encoding mismatch but got %q", rt.errors)
+	}
+}
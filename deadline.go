@@ -0,0 +1,66 @@
+package compress
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// deadlineResponseWriter sets the write deadline of the connection
+// before each write and flush to the underlying response writer.
+// See `WithWriteDeadline`.
+type deadlineResponseWriter struct {
+	http.ResponseWriter
+	timeout  time.Duration
+	timedOut bool
+}
+
+func (w *deadlineResponseWriter) Write(p []byte) (int, error) {
+	w.extendDeadline()
+	n, err := w.ResponseWriter.Write(p)
+	w.checkTimeout(err)
+	return n, err
+}
+
+func (w *deadlineResponseWriter) FlushError() error {
+	w.extendDeadline()
+	err := flushResponseWriter(w.ResponseWriter)
+	w.checkTimeout(err)
+	return err
+}
+
+// Unwrap returns the underlying response writer,
+// e.g. for the http.ResponseController of Go 1.20+.
+func (w *deadlineResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *deadlineResponseWriter) extendDeadline() {
+	// An unsupported deadline is not an error, the write may still block.
+	_ = setWriteDeadline(w.ResponseWriter, time.Now().Add(w.timeout))
+}
+
+func (w *deadlineResponseWriter) checkTimeout(err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		w.timedOut = true
+	}
+}
+
+// setWriteDeadline sets the write deadline of the response writer "rw",
+// or of the first response writer that supports it through its Unwrap chain,
+// like the http.ResponseController of Go 1.20+ does.
+// It returns http.ErrNotSupported if none of them supports it.
+func setWriteDeadline(rw http.ResponseWriter, deadline time.Time) error {
+	for {
+		switch t := rw.(type) {
+		case interface{ SetWriteDeadline(time.Time) error }:
+			return t.SetWriteDeadline(deadline)
+		case interface{ Unwrap() http.ResponseWriter }:
+			rw = t.Unwrap()
+		default:
+			return http.ErrNotSupported
+		}
+	}
+}
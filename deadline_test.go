@@ -0,0 +1,55 @@
+package compress
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// blockingResponseWriter is a response writer of a client which never reads:
+// its writes block until the write deadline, if any, is exceeded.
+type blockingResponseWriter struct {
+	*httptest.ResponseRecorder
+	deadline time.Time
+}
+
+func (w *blockingResponseWriter) SetWriteDeadline(deadline time.Time) error {
+	w.deadline = deadline
+	return nil
+}
+
+func (w *blockingResponseWriter) Write(p []byte) (int, error) {
+	if w.deadline.IsZero() {
+		panic("blocking write without a deadline")
+	}
+
+	time.Sleep(time.Until(w.deadline))
+	return 0, os.ErrDeadlineExceeded
+}
+
+func TestWriteDeadline(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	var writeErr error
+	h := WriteHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, writeErr = w.Write([]byte(testBody))
+	}), WithWriteDeadline(timeout))
+
+	rw := &blockingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	start := time.Now()
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Fatalf("expected the response to be aborted with http.ErrAbortHandler but got %v", v)
+		}
+		if elapsed := time.Since(start); elapsed > 20*timeout {
+			t.Fatalf("expected the write to be aborted on the deadline but it took %s", elapsed)
+		}
+		if !os.IsTimeout(writeErr) {
+			t.Fatalf("expected the handler's write to fail with a timeout but got %v", writeErr)
+		}
+	}()
+
+	h.ServeHTTP(rw, newTestRequest(GZIP))
+}
@@ -0,0 +1,136 @@
+package compress
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+)
+
+// Gzip header flags, see RFC 1952.
+const (
+	gzipFlagHCRC    = 1 << 1
+	gzipFlagExtra   = 1 << 2
+	gzipFlagName    = 1 << 3
+	gzipFlagComment = 1 << 4
+)
+
+// uncheckedGzipReader decompresses gzip data, of one or more members,
+// without verifying the CRC-32 and size trailer of each member.
+// See `WithSkipChecksumVerification`.
+type uncheckedGzipReader struct {
+	r   flate.Reader
+	fr  io.ReadCloser
+	err error
+}
+
+var _ io.ReadCloser = (*uncheckedGzipReader)(nil)
+
+func newUncheckedGzipReader(src io.Reader) (*uncheckedGzipReader, error) {
+	r, ok := src.(flate.Reader)
+	if !ok {
+		r = bufio.NewReader(src)
+	}
+
+	z := &uncheckedGzipReader{r: r}
+	if err := z.readHeader(); err != nil {
+		return nil, err
+	}
+	z.fr = flate.NewReader(r)
+
+	return z, nil
+}
+
+func (z *uncheckedGzipReader) Read(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+
+	n, err := z.fr.Read(p)
+	if err != io.EOF {
+		z.err = err
+		return n, err
+	}
+
+	// End of the member, skip its trailer (CRC-32 and ISIZE) without verifying it.
+	var trailer [8]byte
+	if _, err = io.ReadFull(z.r, trailer[:]); err != nil {
+		z.err = noEOF(err)
+		return n, z.err
+	}
+
+	// Continue with the next member, if any.
+	if err = z.readHeader(); err != nil {
+		z.err = err
+		return n, err
+	}
+
+	z.err = z.fr.(flate.Resetter).Reset(z.r, nil)
+	return n, z.err
+}
+
+func (z *uncheckedGzipReader) Close() error {
+	return z.fr.Close()
+}
+
+// readHeader reads and validates a gzip member header, see RFC 1952.
+// It returns io.EOF if there are no more data.
+func (z *uncheckedGzipReader) readHeader() error {
+	var header [10]byte
+	if _, err := io.ReadFull(z.r, header[:]); err != nil {
+		return err
+	}
+
+	if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 {
+		return gzip.ErrHeader
+	}
+
+	flags := header[3]
+	if flags&gzipFlagExtra != 0 {
+		var size [2]byte
+		if _, err := io.ReadFull(z.r, size[:]); err != nil {
+			return noEOF(err)
+		}
+
+		if _, err := io.CopyN(io.Discard, z.r, int64(binary.LittleEndian.Uint16(size[:]))); err != nil {
+			return noEOF(err)
+		}
+	}
+
+	for _, flag := range [...]byte{gzipFlagName, gzipFlagComment} {
+		if flags&flag == 0 {
+			continue
+		}
+
+		// Zero-terminated string.
+		for {
+			b, err := z.r.ReadByte()
+			if err != nil {
+				return noEOF(err)
+			}
+			if b == 0 {
+				break
+			}
+		}
+	}
+
+	if flags&gzipFlagHCRC != 0 {
+		var crc [2]byte
+		if _, err := io.ReadFull(z.r, crc[:]); err != nil {
+			return noEOF(err)
+		}
+	}
+
+	return nil
+}
+
+// noEOF converts io.EOF to io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
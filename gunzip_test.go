@@ -0,0 +1,130 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// gzipMember returns a gzip member of the "data" with the given header fields.
+func gzipMember(t testing.TB, data string, name, comment string, extra []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Name = name
+	gw.Comment = comment
+	gw.Extra = extra
+	if _, err := io.WriteString(gw, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func readUnchecked(src []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(src), GZIP, WithSkipChecksumVerification())
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+func TestUncheckedGzipReaderMultiMember(t *testing.T) {
+	var stream []byte
+	stream = append(stream, gzipMember(t, "first member, ", "", "", nil)...)
+	stream = append(stream, gzipMember(t, "second member with a name, ", "data.txt", "", nil)...)
+	stream = append(stream, gzipMember(t, "third member with header fields", "data.txt", "a comment", []byte("extra"))...)
+
+	expected := "first member, second member with a name, third member with header fields"
+	got, err := readUnchecked(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != expected {
+		t.Fatalf("expected %q but got %q", expected, got)
+	}
+
+	// The same as the checked reader.
+	if got = decompress(t, GZIP, stream); string(got) != expected {
+		t.Fatalf("expected %q but got %q", expected, got)
+	}
+}
+
+func TestUncheckedGzipReaderSkipsChecksum(t *testing.T) {
+	member := gzipMember(t, testBody, "", "", nil)
+	// Corrupt the CRC-32 of the trailer.
+	member[len(member)-8] ^= 0xff
+
+	if got, err := readUnchecked(member); err != nil || string(got) != testBody {
+		t.Fatalf("expected the data without a checksum error but got %v", err)
+	}
+
+	r, err := NewReader(bytes.NewReader(member), GZIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadAll(r); !errors.Is(err, gzip.ErrChecksum) {
+		t.Fatalf("expected the checked reader to fail with ErrChecksum but got %v", err)
+	}
+}
+
+func TestUncheckedGzipReaderInvalid(t *testing.T) {
+	member := gzipMember(t, testBody, "", "", nil)
+
+	if _, err := readUnchecked([]byte("not a gzip stream")); !errors.Is(err, gzip.ErrHeader) {
+		t.Fatalf("expected ErrHeader but got %v", err)
+	}
+
+	if _, err := readUnchecked(member[:len(member)-4]); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF on a truncated trailer but got %v", err)
+	}
+
+	garbage := append(append([]byte(nil), member...), "garbage!!!"...)
+	if _, err := readUnchecked(garbage); !errors.Is(err, gzip.ErrHeader) {
+		t.Fatalf("expected ErrHeader on trailing garbage but got %v", err)
+	}
+}
+
+// BenchmarkGzipDecode measures the decode throughput of a large trusted body
+// with and without the checksum verification, see `WithSkipChecksumVerification`.
+func BenchmarkGzipDecode(b *testing.B) {
+	data := []byte(strings.Repeat(testBody, 4<<10)) // ~20MB.
+	compressed, err := Compress(GZIP, DefaultCompression, data)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarks := []struct {
+		name string
+		opts []Option
+	}{
+		{"verified", nil},
+		{"unchecked", []Option{WithSkipChecksumVerification()}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				r, err := NewReader(bytes.NewReader(compressed), GZIP, bm.opts...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = io.Copy(io.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+				r.Close()
+			}
+		})
+	}
+}
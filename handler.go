@@ -1,41 +1,220 @@
 package compress
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
 
 // Handler wraps a Handler and returns a new one
 // which makes future Write calls to compress the data before sent
 // and future request body to decompress the incoming data before read.
-func Handler(next http.Handler) http.HandlerFunc {
-	return WriteHandler(ReadHandler(next))
+// Optional "opts" customize the compression behavior, see `Option`.
+func Handler(next http.Handler, opts ...Option) http.HandlerFunc {
+	return WriteHandler(ReadHandler(next, opts...), opts...)
 }
 
 // WriteHandler is the write using compression middleware.
-func WriteHandler(next http.Handler) http.HandlerFunc {
+func WriteHandler(next http.Handler, opts ...Option) http.HandlerFunc {
+	c := newConfig(opts)
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		cr, err := NewResponseWriter(w, r, -1)
+		if DisabledFromContext(r.Context()) || !c.compressPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if c.strictAcceptEncoding {
+			if err := ValidateAcceptEncoding(acceptEncodingValues(r, c)); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+		}
+
+		cr, err := newResponseWriter(w, r, c.level, c)
 		if err != nil {
+			if errors.Is(err, ErrNotAcceptable) {
+				WriteNotAcceptable(w)
+				return
+			}
+
 			next.ServeHTTP(w, r)
 			return
 		}
-		defer cr.Close()
+		completed := false
+		defer func() {
+			if !completed {
+				// The handler panicked, the response may be incomplete.
+				cr.abortResponseCache()
+			}
+
+			if err := cr.Close(); err != nil && c.closeErrorHandler != nil {
+				c.closeErrorHandler(r, &CloseError{Err: err})
+			}
+
+			if cr.writeTimedOut() {
+				// Abort the response, the server closes the connection.
+				panic(http.ErrAbortHandler)
+			}
+		}()
 
 		r.Header.Del(AcceptEncodingHeaderKey)
 		next.ServeHTTP(cr, r)
+		completed = true
 	}
 }
 
+// CloseError is passed to the `WithCloseErrorHandler` function by `WriteHandler`
+// when the compressed response cannot be finalized, e.g. the client is gone,
+// so the response may be truncated. Check that error with `errors.As`.
+type CloseError struct {
+	Err error
+}
+
+func (e *CloseError) Error() string {
+	return "compress: close response: " + e.Err.Error()
+}
+
+func (e *CloseError) Unwrap() error {
+	return e.Err
+}
+
+type disabledContextKey struct{}
+
+// WithCompressionDisabled returns a copy of the "ctx" which disables
+// the response compression of its request. Upstream middlewares can use it
+// to disable compression per request, e.g. after inspecting the route metadata:
+//
+//	next.ServeHTTP(w, r.WithContext(compress.WithCompressionDisabled(r.Context())))
+//
+// The `WriteHandler` serves such requests through the original response writer.
+func WithCompressionDisabled(ctx context.Context) context.Context {
+	return context.WithValue(ctx, disabledContextKey{}, true)
+}
+
+// DisabledFromContext reports whether the response compression
+// was disabled through `WithCompressionDisabled`.
+func DisabledFromContext(ctx context.Context) bool {
+	disabled, _ := ctx.Value(disabledContextKey{}).(bool)
+	return disabled
+}
+
 // ReadHandler is the decompress and read request body middleware.
-func ReadHandler(next http.Handler) http.HandlerFunc {
+// It can be used standalone, without `WriteHandler`,
+// by services which accept compressed uploads but serve plain responses.
+//
+// Its behavior is customized through the options:
+//   - `WithUnsupportedEncodingHandler` handles requests compressed using
+//     an encoding the server does not support (415 by default).
+//   - `WithErrorHandler` handles requests whose body cannot be decompressed,
+//     e.g. of an invalid gzip header.
+//   - `WithMaxDecompressedSize` limits the decompressed body size.
+//   - `WithRequestEncodingSniffing` detects compressed bodies sent without
+//     a "Content-Encoding" header.
+//   - `WithReadAheadLimit` and `WithSkipChecksumVerification` tune the decoders.
+//
+// The compressed and the decompressed body sizes are limited independently.
+// An `http.MaxBytesReader`, applied by a middleware which runs before ReadHandler,
+// limits the compressed body, as it is read from the client,
+// and `WithMaxDecompressedSize` limits the decompressed body the handler reads.
+// Either limit fails the body's Read with a `BodyTooLargeError`
+// which reports the one that was exceeded:
+//
+//	var tooLarge *compress.BodyTooLargeError
+//	if errors.As(err, &tooLarge) && tooLarge.Compressed { ... }
+//
+// Note that an `http.MaxBytesReader` applied by the "next" handler, after ReadHandler,
+// limits the decompressed body instead and it fails with its own *http.MaxBytesError.
+func ReadHandler(next http.Handler, opts ...Option) http.HandlerFunc {
+	c := newConfig(opts)
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		encoding := r.Header.Get(ContentEncodingHeaderKey)
+		encoding := r.Header.Get(c.contentEncodingHeaderKey)
+		if encoding == "" && c.sniffRequestEncoding && r.Body != nil && r.Body != http.NoBody {
+			encoding, r.Body = sniffEncoding(r.Body)
+		}
+
 		if encoding != "" {
-			rc, err := NewReader(r.Body, encoding)
-			if err == nil {
+			rc, err := newReader(r.Body, encoding, c)
+			if err != nil {
+				if errors.Is(err, ErrNotSupportedCompression) && c.unsupportedEncodingHandler != nil {
+					c.unsupportedEncodingHandler.ServeHTTP(w, r)
+					return
+				}
+
+				if !errors.Is(err, ErrRequestNotCompressed) && c.errorHandler != nil {
+					c.errorHandler(w, r, err)
+					return
+				}
+			} else {
 				defer rc.Close()
-				r.Body = rc
+				if sr, err := rc.Seekable(); err == nil {
+					r.Body = sr
+				} else {
+					r.Body = rc
+				}
 			}
 		}
 
 		next.ServeHTTP(w, r)
 	}
 }
+
+// WriteNotAcceptable responds with 406 Not Acceptable and a short
+// plain text body which lists the encodings the server supports,
+// see `SupportedEncodings`. No compression headers are set.
+func WriteNotAcceptable(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del(ContentEncodingHeaderKey)
+	h.Set(ContentTypeHeaderKey, "text/plain; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotAcceptable)
+	fmt.Fprintf(w, "%s\nSupported encodings: %s\n",
+		http.StatusText(http.StatusNotAcceptable), strings.Join(SupportedEncodings(), ", "))
+}
+
+// ServeReader negotiates the response encoding and streams the "src"
+// to the client through the compressor, with the "Content-Type" header set
+// to the given "contentType" (if empty, it is detected from the data).
+// When the response cannot be compressed, e.g. the client does not accept
+// any of the server's encodings, the data are written as they are.
+//
+// The response is completed (the compressor is closed) when ServeReader returns,
+// closing the "src" is the caller's responsibility.
+// Optional "opts" customize the negotiation and the compression level, see `Option`.
+func ServeReader(w http.ResponseWriter, r *http.Request, src io.Reader, contentType string, opts ...Option) error {
+	if contentType != "" {
+		w.Header().Set(ContentTypeHeaderKey, contentType)
+	}
+
+	c := newConfig(opts)
+	cw, err := newResponseWriter(w, r, c.level, c)
+	if err != nil {
+		if errors.Is(err, ErrNotAcceptable) {
+			WriteNotAcceptable(w)
+			return err
+		}
+
+		_, err = io.Copy(w, src)
+		return err
+	}
+
+	// Flush once, at the end.
+	cw.AutoFlush = false
+	if contentType != "" {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	_, err = cw.ReadFrom(src)
+	if err != nil {
+		cw.abortResponseCache()
+	}
+	if closeErr := cw.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,404 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// echoBody responds with the request body as it is read by the handler.
+func echoBody(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Write(body)
+}
+
+// compressData returns the "data" compressed using the given "encoding".
+func compressData(t testing.TB, encoding string, data []byte) []byte {
+	t.Helper()
+
+	b, err := Compress(encoding, DefaultCompression, data)
+	if err != nil {
+		t.Fatalf("%s: compress: %v", encoding, err)
+	}
+
+	return b
+}
+
+func newUploadRequest(encoding string, body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	if encoding != "" {
+		r.Header.Set(ContentEncodingHeaderKey, encoding)
+	}
+
+	return r
+}
+
+func TestReadHandlerUnsupportedEncoding(t *testing.T) {
+	called := false
+	h := ReadHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	rec := serve(h, newUploadRequest("zstd", []byte("compressed")))
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected status code %d but got %d", http.StatusUnsupportedMediaType, rec.Code)
+	}
+	if called {
+		t.Fatal("expected the next handler not to be executed")
+	}
+}
+
+func TestReadHandlerUnsupportedEncodingPassThrough(t *testing.T) {
+	h := ReadHandler(http.HandlerFunc(echoBody), WithUnsupportedEncodingHandler(nil))
+
+	rec := serve(h, newUploadRequest("zstd", []byte("compressed")))
+	if rec.Code != http.StatusOK || rec.Body.String() != "compressed" {
+		t.Fatalf("expected the body to be passed through but got %d: %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReadHandlerNotCompressed(t *testing.T) {
+	h := ReadHandler(http.HandlerFunc(echoBody))
+
+	for _, encoding := range []string{"", IDENTITY} {
+		rec := serve(h, newUploadRequest(encoding, []byte("plain")))
+		if rec.Code != http.StatusOK || rec.Body.String() != "plain" {
+			t.Fatalf("%q: expected the body to be passed through but got %d: %q", encoding, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestWriteHandlerStrictAcceptEncoding(t *testing.T) {
+	h := WriteHandler(http.HandlerFunc(writeTestBody), WithStrictAcceptEncoding())
+
+	for _, value := range []string{"gzip;q=", ";;;", "q=2"} {
+		rec := serve(h, newTestRequest(value))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%q: expected status code %d but got %d", value, http.StatusBadRequest, rec.Code)
+		}
+	}
+
+	expectResponse(t, serve(h, newTestRequest("gzip;q=0.5")), GZIP, testBody)
+}
+
+func TestWriteHandlerLenientAcceptEncoding(t *testing.T) {
+	h := WriteHandler(http.HandlerFunc(writeTestBody))
+
+	for _, value := range []string{"gzip;q=", ";;;", "q=2"} {
+		rec := serve(h, newTestRequest(value))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: expected status code %d but got %d", value, http.StatusOK, rec.Code)
+		}
+		expectResponse(t, rec, "", testBody)
+	}
+}
+
+// TestWriteHandlerConcurrentPooledWriters serves many concurrent requests,
+// run it with -race, so the pooled writers are shared across them.
+// Each response must be decoded to its own body, not corrupted
+// or interleaved with another response.
+func TestWriteHandlerConcurrentPooledWriters(t *testing.T) {
+	const requests = 1000
+
+	h := WriteHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		for i := 0; i < 20; i++ {
+			fmt.Fprintf(w, "response %s, line %d\n", id, i)
+		}
+	}))
+
+	encodings := []string{GZIP, DEFLATE, BROTLI, SNAPPY}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			encoding := encodings[i%len(encodings)]
+			r := httptest.NewRequest(http.MethodGet, "/?id="+strconv.Itoa(i), nil)
+			r.Header.Set(AcceptEncodingHeaderKey, encoding)
+			rec := serve(h, r)
+
+			var expected strings.Builder
+			for line := 0; line < 20; line++ {
+				fmt.Fprintf(&expected, "response %d, line %d\n", i, line)
+			}
+
+			rd, err := NewReader(rec.Body, rec.Header().Get(ContentEncodingHeaderKey))
+			if err != nil {
+				errs <- fmt.Errorf("request %d: %v", i, err)
+				return
+			}
+			body, err := io.ReadAll(rd)
+			if err != nil {
+				errs <- fmt.Errorf("request %d: %s: %v", i, encoding, err)
+				return
+			}
+			if string(body) != expected.String() {
+				errs <- fmt.Errorf("request %d: %s: corrupted body: %q", i, encoding, body)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestWriteHandlerStrictNegotiation(t *testing.T) {
+	h := WriteHandler(http.HandlerFunc(writeTestBody), WithStrictNegotiation())
+
+	rec := serve(h, newTestRequest("zstd, identity;q=0"))
+	if rec.Code != http.StatusNotAcceptable {
+		t.Fatalf("expected status code %d but got %d", http.StatusNotAcceptable, rec.Code)
+	}
+	if got := rec.Header().Get(ContentEncodingHeaderKey); got != "" {
+		t.Fatalf("expected no Content-Encoding header but got %q", got)
+	}
+
+	body := rec.Body.String()
+	for _, encoding := range []string{GZIP, DEFLATE, BROTLI, SNAPPY, S2} {
+		if !strings.Contains(body, encoding) {
+			t.Fatalf("expected the body to list %q but got %q", encoding, body)
+		}
+	}
+
+	// The identity encoding is not refused, the response is sent uncompressed.
+	expectResponse(t, serve(h, newTestRequest("zstd")), "", testBody)
+}
+
+func TestServeReader(t *testing.T) {
+	data := strings.Repeat(testBody, 100) // larger than the copy buffers.
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := ServeReader(w, r, strings.NewReader(data), "application/json"); err != nil {
+			t.Errorf("serve reader: %v", err)
+		}
+	})
+
+	for _, encoding := range []string{GZIP, BROTLI, ""} {
+		rec := serve(h, newTestRequest(encoding))
+		if got := rec.Header().Get(ContentTypeHeaderKey); got != "application/json" {
+			t.Fatalf("%q: expected content type %q but got %q", encoding, "application/json", got)
+		}
+		expectResponse(t, rec, encoding, data)
+		if encoding != "" && rec.Body.Len() >= len(data) {
+			t.Fatalf("%s: expected a compressed body but got %d bytes", encoding, rec.Body.Len())
+		}
+	}
+}
+
+func TestReadHandlerOptions(t *testing.T) {
+	var handlerErr error
+	h := ReadHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if handlerErr = err; err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.Write(body)
+	}),
+		WithMaxDecompressedSize(int64(len(testBody))),
+		WithRequestEncodingSniffing(),
+		WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}),
+		WithUnsupportedEncodingHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotImplemented)
+		})),
+	)
+
+	// Read-only: the response is not compressed, even if it is accepted.
+	r := newUploadRequest(GZIP, compressData(t, GZIP, []byte(testBody)))
+	r.Header.Set(AcceptEncodingHeaderKey, GZIP)
+	expectResponse(t, serve(h, r), "", testBody)
+
+	// Sniffing.
+	for _, encoding := range []string{GZIP, SNAPPY, S2} {
+		rec := serve(h, newUploadRequest("", compressData(t, encoding, []byte(testBody))))
+		if rec.Code != http.StatusOK || rec.Body.String() != testBody {
+			t.Fatalf("%s: expected the sniffed body to be decompressed but got %d: %q", encoding, rec.Code, rec.Body.String())
+		}
+	}
+
+	// Max decompressed size.
+	rec := serve(h, newUploadRequest(GZIP, compressData(t, GZIP, []byte(testBody+"!"))))
+	var tooLarge *BodyTooLargeError
+	if rec.Code != http.StatusRequestEntityTooLarge || !errors.As(handlerErr, &tooLarge) || tooLarge.Compressed {
+		t.Fatalf("expected a decompressed BodyTooLargeError but got %d: %v", rec.Code, handlerErr)
+	}
+
+	// Error callback.
+	if rec = serve(h, newUploadRequest(GZIP, []byte("not a gzip stream"))); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected the error handler's status code %d but got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	// Unsupported encoding.
+	if rec = serve(h, newUploadRequest("zstd", []byte("compressed"))); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected the unsupported encoding handler's status code %d but got %d", http.StatusNotImplemented, rec.Code)
+	}
+}
+
+func TestWriteHandlerCompressionDisabled(t *testing.T) {
+	h := WriteHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(*ResponseWriter); ok && DisabledFromContext(r.Context()) {
+			t.Error("expected the original response writer")
+		}
+		writeTestBody(w, r)
+	}))
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("disable") != "" {
+			r = r.WithContext(WithCompressionDisabled(r.Context()))
+		}
+		h.ServeHTTP(w, r)
+	})
+
+	r := newTestRequest(GZIP)
+	r.URL.RawQuery = "disable=1"
+	rec := serve(upstream, r)
+	expectResponse(t, rec, "", testBody)
+	if got := rec.Header().Get(VaryHeaderKey); got != "" {
+		t.Fatalf("expected no Vary header but got %q", got)
+	}
+
+	expectResponse(t, serve(upstream, newTestRequest(GZIP)), GZIP, testBody)
+}
+
+func TestReadHandlerBodyLimits(t *testing.T) {
+	compressed := compressData(t, GZIP, []byte(testBody))
+
+	newHandler := func(maxBytes int64, opts ...Option) http.Handler {
+		var h http.Handler = ReadHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.Copy(io.Discard, r.Body)
+			var tooLarge *BodyTooLargeError
+			if !errors.As(err, &tooLarge) {
+				http.Error(w, fmt.Sprintf("unexpected error: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("X-Compressed", strconv.FormatBool(tooLarge.Compressed))
+			w.Header().Set("X-Limit", strconv.FormatInt(tooLarge.Limit, 10))
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}), opts...)
+
+		if maxBytes > 0 {
+			next := h
+			h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+				next.ServeHTTP(w, r)
+			})
+		}
+
+		return h
+	}
+
+	tests := []struct {
+		name       string
+		h          http.Handler
+		compressed string
+		limit      string
+	}{
+		// The compressed body is larger than the MaxBytesReader limit,
+		// the decompressed one is within WithMaxDecompressedSize.
+		{"compressed", newHandler(16, WithMaxDecompressedSize(int64(len(testBody)))), "true", "16"},
+		// The compressed body is within the MaxBytesReader limit,
+		// the decompressed one is larger than WithMaxDecompressedSize.
+		{"decompressed", newHandler(int64(len(compressed)), WithMaxDecompressedSize(100)), "false", "100"},
+	}
+
+	for _, tt := range tests {
+		rec := serve(tt.h, newUploadRequest(GZIP, compressed))
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("%s: expected status code %d but got %d: %s", tt.name, http.StatusRequestEntityTooLarge, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("X-Compressed"); got != tt.compressed {
+			t.Fatalf("%s: expected Compressed to be %s but got %s", tt.name, tt.compressed, got)
+		}
+		if got := rec.Header().Get("X-Limit"); got != tt.limit {
+			t.Fatalf("%s: expected Limit to be %s but got %s", tt.name, tt.limit, got)
+		}
+	}
+
+	// Both limits are satisfied.
+	h := func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(len(compressed)))
+		ReadHandler(http.HandlerFunc(echoBody), WithMaxDecompressedSize(int64(len(testBody)))).ServeHTTP(w, r)
+	}
+	rec := serve(http.HandlerFunc(h), newUploadRequest(GZIP, compressed))
+	if rec.Code != http.StatusOK || rec.Body.String() != testBody {
+		t.Fatalf("expected the body to be read within both limits but got %d", rec.Code)
+	}
+}
+
+func TestContentEncodingHeaderKeyRoundTrip(t *testing.T) {
+	const key = "X-Body-Encoding"
+
+	h := Handler(http.HandlerFunc(echoBody), WithContentEncodingHeaderKey(key))
+
+	for _, encoding := range []string{GZIP, BROTLI, SNAPPY} {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compressData(t, encoding, []byte(testBody))))
+		r.Header.Set(key, encoding)
+		r.Header.Set(AcceptEncodingHeaderKey, encoding)
+		rec := serve(h, r)
+
+		if got := rec.Header().Get(ContentEncodingHeaderKey); got != "" {
+			t.Fatalf("%s: expected no Content-Encoding header but got %q", encoding, got)
+		}
+		if got := rec.Header().Get(key); got != encoding {
+			t.Fatalf("%s: expected %s: %s but got %q", encoding, key, encoding, got)
+		}
+		if got := decompress(t, encoding, rec.Body.Bytes()); string(got) != testBody {
+			t.Fatalf("%s: expected the request body to be echoed but got %q", encoding, got)
+		}
+	}
+
+	// The standard header is not read.
+	r := newUploadRequest(GZIP, []byte("plain"))
+	if rec := serve(h, r); rec.Body.String() != "plain" {
+		t.Fatalf("expected the body to be read as it is but got %q", rec.Body.String())
+	}
+}
+
+func TestWriteHandlerCloseErrorHandler(t *testing.T) {
+	var (
+		rw       = &failingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+		closeErr error
+	)
+
+	h := WriteHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeTestBody(w, r)
+		// The client is gone before the response is finalized.
+		rw.failing = true
+	}),
+		WithCloseErrorHandler(func(r *http.Request, err error) {
+			closeErr = err
+		}),
+		WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			t.Errorf("expected the request error handler not to be called but got %v", err)
+		}),
+	)
+
+	h.ServeHTTP(rw, newTestRequest(GZIP))
+
+	var ce *CloseError
+	if !errors.As(closeErr, &ce) || !errors.Is(closeErr, errBrokenPipe) {
+		t.Fatalf("expected a CloseError of the write error but got %v", closeErr)
+	}
+}
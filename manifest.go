@@ -0,0 +1,74 @@
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrInvalidManifest returned from NewManifestReader
+// when the source does not start with a valid encoding manifest.
+var ErrInvalidManifest = errors.New("compress: invalid encoding manifest")
+
+// maxManifestLength is the maximum length of a manifest's encoding token.
+const maxManifestLength = 255
+
+// NewManifestWriter returns a Writer of "w" based on the given "encoding",
+// like `NewWriter` does, which declares its encoding on the stream itself:
+// it writes the manifest, a single byte of the encoding token's length
+// followed by the token, e.g. "\x02br", and then the compressed data.
+//
+// The stream can be read by `NewManifestReader`.
+func NewManifestWriter(w io.Writer, encoding string, level int) (Writer, error) {
+	if _, ok := LookupCodec(encoding); !ok {
+		return nil, ErrNotSupportedCompression
+	}
+
+	encoding = canonicalEncoding(encoding)
+	if len(encoding) > maxManifestLength {
+		return nil, fmt.Errorf("%w: encoding token is too long", ErrInvalidManifest)
+	}
+
+	manifest := make([]byte, 0, 1+len(encoding))
+	manifest = append(manifest, byte(len(encoding)))
+	manifest = append(manifest, encoding...)
+	if _, err := w.Write(manifest); err != nil {
+		return nil, err
+	}
+
+	return NewWriter(w, encoding, level)
+}
+
+// NewManifestReader returns a new "Reader" wrapper of "src"
+// which starts with an encoding manifest, see `NewManifestWriter`.
+// It reads the manifest and it decompresses the rest of the data
+// using the declared encoding.
+//
+// It returns `ErrInvalidManifest` if the manifest is missing or malformed
+// and `ErrNotSupportedCompression` if the declared encoding is unknown.
+func NewManifestReader(src io.Reader, opts ...Option) (*Reader, error) {
+	if src == nil {
+		return nil, ErrRequestNotCompressed
+	}
+
+	var length [1]byte
+	if _, err := io.ReadFull(src, length[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+
+	if length[0] == 0 {
+		return nil, fmt.Errorf("%w: empty encoding token", ErrInvalidManifest)
+	}
+
+	token := make([]byte, length[0])
+	if _, err := io.ReadFull(src, token); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+
+	encoding := string(token)
+	if _, ok := LookupCodec(encoding); !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotSupportedCompression, encoding)
+	}
+
+	return NewReader(src, encoding, opts...)
+}
@@ -0,0 +1,59 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestManifestReader(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewManifestWriter(&buf, BROTLI, DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, testBody)
+	w.Close()
+
+	if !bytes.HasPrefix(buf.Bytes(), []byte("\x02br")) {
+		t.Fatalf("expected the stream to start with the manifest but got % x", buf.Bytes()[:3])
+	}
+
+	r, err := NewManifestReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if r.Encoding != BROTLI {
+		t.Fatalf("expected encoding %q but got %q", BROTLI, r.Encoding)
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != testBody {
+		t.Fatalf("expected the original data but got %q", body)
+	}
+}
+
+func TestManifestReaderInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		{"empty", nil, ErrInvalidManifest},
+		{"empty token", []byte{0}, ErrInvalidManifest},
+		{"truncated token", []byte("\x04gz"), ErrInvalidManifest},
+		{"unknown token", []byte("\x04zstd..."), ErrNotSupportedCompression},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewManifestReader(bytes.NewReader(tt.stream)); !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected %v but got %v", tt.name, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package compress
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// messagePrefixSize is the size of the big-endian length prefix of each message.
+const messagePrefixSize = 4
+
+// ErrMessageTooLarge is returned by the `MessageStreamWriter` when a message does not fit
+// to its 4-byte length prefix, by the `MessageStreamReader` when a message's length
+// exceeds the `WithMaxMessageSize` limit and by the `PerMessageDeflateReader`
+// when a decompressed message exceeds that limit.
+var ErrMessageTooLarge = errors.New("compress: message too large")
+
+// MessageStreamWriter writes a stream of messages, e.g. protobuf messages,
+// each one prefixed by its length as a 4-byte big-endian unsigned integer,
+// through a single compressor. The compression context is retained across messages,
+// for a better ratio than compressing each message on its own,
+// and the compressor is flushed after each message, so the peer can read
+// a message as soon as it is written. Read the stream with `MessageStreamReader`.
+// It is not safe for concurrent use.
+type MessageStreamWriter struct {
+	w      Writer
+	prefix [messagePrefixSize]byte
+}
+
+// NewMessageStreamWriter returns a new MessageStreamWriter which writes
+// the compressed stream to "w", based on the given "encoding" and "level", see `NewWriter`.
+// Optional "opts" customize the compressor, e.g. `WithBrotliWindow`.
+//
+// The `DefaultCompression` of the "gzip" and "deflate" encodings is level 7,
+// as levels 1 to 6 store small flushed messages as they are,
+// see `NewPerMessageDeflateWriter`. Note that "snappy" and "s2" compress
+// each flushed block on its own, they do not retain the context across messages,
+// so small messages are expanded a bit by them.
+func NewMessageStreamWriter(w io.Writer, encoding string, level int, opts ...Option) (*MessageStreamWriter, error) {
+	if level == DefaultCompression {
+		if e := canonicalEncoding(encoding); e == GZIP || e == DEFLATE {
+			level = perMessageDeflateDefaultLevel
+		}
+	}
+
+	cw, err := newWriter(w, encoding, level, newConfig(opts).writer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MessageStreamWriter{w: cw}, nil
+}
+
+// WriteMessage writes the length-prefixed "message" and flushes the compressor.
+// Callers which write to an http.ResponseWriter should flush it too,
+// to send the message to the client.
+func (w *MessageStreamWriter) WriteMessage(message []byte) error {
+	if uint64(len(message)) > math.MaxUint32 {
+		return ErrMessageTooLarge
+	}
+
+	binary.BigEndian.PutUint32(w.prefix[:], uint32(len(message)))
+	if _, err := w.w.Write(w.prefix[:]); err != nil {
+		return err
+	}
+
+	if _, err := w.w.Write(message); err != nil {
+		return err
+	}
+
+	return w.w.Flush()
+}
+
+// Close closes the compressor, it does not close the underlying writer.
+func (w *MessageStreamWriter) Close() error {
+	return w.w.Close()
+}
+
+// MessageStreamReader reads the messages written by a `MessageStreamWriter`.
+// It is not safe for concurrent use.
+type MessageStreamReader struct {
+	src      io.Reader
+	encoding string
+	c        *config
+
+	r      *Reader
+	prefix [messagePrefixSize]byte
+}
+
+// NewMessageStreamReader returns a new MessageStreamReader which decompresses
+// the stream of "src" using the given "encoding".
+// The decompressor is created on the first `ReadMessage` call,
+// so the constructor does not block waiting for the stream's header.
+// Optional "opts" customize the decompressor, see `NewReader`,
+// and the maximum message size, see `WithMaxMessageSize`.
+func NewMessageStreamReader(src io.Reader, encoding string, opts ...Option) (*MessageStreamReader, error) {
+	if _, ok := LookupCodec(encoding); !ok {
+		return nil, ErrNotSupportedCompression
+	}
+
+	return &MessageStreamReader{src: src, encoding: encoding, c: newConfig(opts)}, nil
+}
+
+// ReadMessage reads and returns the next message.
+// The returned slice is owned by the caller.
+// It returns io.EOF when the stream ends at a message boundary
+// and io.ErrUnexpectedEOF when it ends in the middle of a message.
+func (r *MessageStreamReader) ReadMessage() ([]byte, error) {
+	if r.r == nil {
+		rr, err := newReader(r.src, r.encoding, r.c)
+		if err != nil {
+			return nil, err
+		}
+		r.r = rr
+	}
+
+	if _, err := io.ReadFull(r.r, r.prefix[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(r.prefix[:])
+	if limit := r.c.maxMessageSize; limit > 0 && uint64(size) > uint64(limit) {
+		return nil, ErrMessageTooLarge
+	}
+
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r.r, message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// Close closes the decompressor, it does not close the source.
+func (r *MessageStreamReader) Close() error {
+	if r.r == nil {
+		return nil
+	}
+
+	return r.r.ReadCloser.Close()
+}
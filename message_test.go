@@ -0,0 +1,119 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestMessageStream(t *testing.T) {
+	const messages = 1000
+
+	for _, encoding := range []string{GZIP, DEFLATE, BROTLI, SNAPPY, S2} {
+		var buf bytes.Buffer
+		w, err := NewMessageStreamWriter(&buf, encoding, DefaultCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var total int
+		for i := 0; i < messages; i++ {
+			message := []byte(fmt.Sprintf(`{"id":%d,"name":"message %d"}`, i, i))
+			if i%100 == 0 {
+				message = nil // empty messages are framed too.
+			}
+			total += messagePrefixSize + len(message)
+			if err = w.WriteMessage(message); err != nil {
+				t.Fatalf("%s: write message %d: %v", encoding, i, err)
+			}
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The compression context is retained across messages.
+		if encoding != SNAPPY && encoding != S2 && buf.Len() >= total/2 {
+			t.Fatalf("%s: expected the stream to be compressed but got %d bytes of %d", encoding, buf.Len(), total)
+		}
+
+		r, err := NewMessageStreamReader(&buf, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < messages; i++ {
+			expected := fmt.Sprintf(`{"id":%d,"name":"message %d"}`, i, i)
+			if i%100 == 0 {
+				expected = ""
+			}
+
+			message, err := r.ReadMessage()
+			if err != nil {
+				t.Fatalf("%s: read message %d: %v", encoding, i, err)
+			}
+			if string(message) != expected {
+				t.Fatalf("%s: message %d: expected %q but got %q", encoding, i, expected, message)
+			}
+		}
+		if _, err = r.ReadMessage(); err != io.EOF {
+			t.Fatalf("%s: expected io.EOF at the end of the stream but got %v", encoding, err)
+		}
+		r.Close()
+	}
+}
+
+func TestMessageStreamMaxMessageSize(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewMessageStreamWriter(&buf, GZIP, DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{100, 101} {
+		if err = w.WriteMessage(bytes.Repeat([]byte("a"), size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	stream := buf.Bytes()
+
+	r, err := NewMessageStreamReader(bytes.NewReader(stream), GZIP, WithMaxMessageSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message, err := r.ReadMessage(); err != nil || len(message) != 100 {
+		t.Fatalf("expected a message of 100 bytes but got %d: %v", len(message), err)
+	}
+	if _, err = r.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("expected ErrMessageTooLarge but got %v", err)
+	}
+
+	// The default limit is 4MB.
+	if r, err = NewMessageStreamReader(bytes.NewReader(stream), GZIP); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = r.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMessageStreamUnexpectedEOF(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewMessageStreamWriter(&buf, SNAPPY, DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A length prefix of 10 bytes followed by 3 bytes of data.
+	w.w.Write([]byte{0, 0, 0, 10, 'a', 'b', 'c'})
+	w.Close()
+
+	r, err := NewMessageStreamReader(&buf, SNAPPY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.ReadMessage(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF but got %v", err)
+	}
+}
@@ -0,0 +1,726 @@
+package compress
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Option is a function which modifies the compress configuration.
+// Options can be passed to `Handler`, `WriteHandler`, `ReadHandler`,
+// `NewResponseWriter`, `NewWriter` and `NewReader`.
+//
+// Each handler or writer builds its own configuration from its options,
+// options never modify a configuration shared with another handler.
+// Options are applied in order, so a later option overrides the value
+// set by an earlier one, e.g. the `WithLevel(1)` of
+// Handler(next, base, compress.WithLevel(1)) overrides any level of the "base" options.
+// Options of a list, e.g. `WithPathPrefixes`, add to the list instead.
+// See `Options` to compose a base policy which is shared by many handlers.
+type Option func(*config)
+
+// Options returns a single Option which applies the given "opts" in order.
+// It can be used to define a base policy once and override it per handler:
+//
+//	base := compress.Options(compress.WithLevel(5), compress.WithPathPrefixes("/api/"))
+//	mux.Handle("/api/", compress.Handler(api, base))
+//	mux.Handle("/api/logs", compress.Handler(logs, base, compress.WithLevel(1)))
+func Options(opts ...Option) Option {
+	opts = append([]Option(nil), opts...)
+
+	return func(c *config) {
+		for _, opt := range opts {
+			if opt != nil {
+				opt(c)
+			}
+		}
+	}
+}
+
+type config struct {
+	// See `WithLevel`.
+	level int
+	// See `WithOffers`.
+	offers []string
+	// See `WithEncodingChooser`.
+	encodingChooser func(r *http.Request, candidates []string) string
+	// See `WithContentEncodingHeaderKey`.
+	contentEncodingHeaderKey string
+	// See `WithPathPrefixes` and `WithExcludedPathPrefixes`.
+	pathPrefixes         []string
+	excludedPathPrefixes []string
+	// See `WithSkipExtensions`.
+	skipExtensions []string
+	// See `WithTrustedForwardedAcceptEncoding`.
+	forwardedAcceptEncodingKey string
+	trustedProxies             []*net.IPNet
+	// See `WithDefaultEncodingWhenAbsent`.
+	defaultEncoding string
+	// See `WithUserAgentFilter`.
+	userAgentFilter func(ua string) (allowEncoding bool, forceEncoding string)
+	// See `WithUnsupportedEncodingHandler`.
+	unsupportedEncodingHandler http.Handler
+	// See `WithAdaptiveLevel`.
+	adaptiveLevel bool
+	// See `WithIdentityFallback`.
+	identityFallback bool
+	// See `WithReadAheadLimit`.
+	readAheadLimit int
+	// See `WithStrictAcceptEncoding`.
+	strictAcceptEncoding bool
+	// See `WithMaxAcceptSpecs`.
+	maxAcceptSpecs int
+	// See `WithContentLengthHint`.
+	contentLengthHint  bool
+	minContentLength   int64
+	largeContentLength int64
+	// See `WithStrictNegotiation`.
+	strictNegotiation bool
+	// See `WithS2Upgrade`.
+	s2UpgradeSize int64
+	// See `WithStreamingThreshold`.
+	streamingThreshold int64
+	// See `WithFullBuffering`.
+	fullBufferingSize int
+	// See `WithWriteDeadline`.
+	writeDeadline time.Duration
+	// See `WithResponseCache`.
+	responseCache *responseCache
+	// See `WithSkipChecksumVerification`.
+	skipChecksumVerification bool
+	// See `WithMaxDecompressedSize`.
+	maxDecompressedSize int64
+	// See `WithSeekableBody`.
+	seekableBodyBuffer int
+	// See `WithErrorHandler`.
+	errorHandler func(w http.ResponseWriter, r *http.Request, err error)
+	// See `WithCloseErrorHandler`.
+	closeErrorHandler func(r *http.Request, err error)
+	// See `WithRequestEncodingSniffing`.
+	sniffRequestEncoding bool
+	// See `WithMaxMessageSize`.
+	maxMessageSize int
+	// Encoding-specific writer settings.
+	writer writerOptions
+}
+
+// writerOptions are the encoding-specific settings of the writers.
+// It is comparable, writers are pooled per options too.
+type writerOptions struct {
+	// See `WithBrotliWindow`.
+	brotliLGWin int
+	// See `WithReproducibleGzip`.
+	reproducibleGzip bool
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		level:                      DefaultCompression,
+		contentEncodingHeaderKey:   ContentEncodingHeaderKey,
+		unsupportedEncodingHandler: http.HandlerFunc(unsupportedEncoding),
+		maxAcceptSpecs:             defaultMaxAcceptSpecs,
+		maxMessageSize:             defaultMaxMessageSize,
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(c)
+		}
+	}
+
+	return c
+}
+
+// WithLevel sets the compression level of the `WriteHandler` and `ServeReader` responses,
+// see `DefaultCompression` and `HuffmanOnly`.
+//
+// Defaults to `DefaultCompression`.
+func WithLevel(level int) Option {
+	return func(c *config) {
+		c.level = level
+	}
+}
+
+// WithOffers sets the encodings the server offers to the clients,
+// in order of preference, e.g. compress.WithOffers(compress.BROTLI, compress.GZIP).
+// The encodings should be registered ones, see `Register`.
+//
+// Defaults to nil, the `DefaultOffers` are used.
+func WithOffers(offers ...string) Option {
+	offers = append([]string(nil), offers...)
+
+	return func(c *config) {
+		c.offers = offers
+	}
+}
+
+// encodingOffers returns the encodings the server offers, see `WithOffers`.
+func (c *config) encodingOffers() []string {
+	if len(c.offers) == 0 {
+		return DefaultOffers
+	}
+
+	return c.offers
+}
+
+// WithEncodingChooser registers a function which selects the response encoding
+// among the "candidates", the server-supported encodings the client accepts,
+// ordered by preference (the best negotiated encoding comes first).
+// The chooser is not called when the client accepts none of the server's encodings.
+//
+// It can be used to implement any selection policy, e.g. weighted A/B testing
+// of compression algorithms. If the chooser returns an empty string
+// or a value that is not one of the "candidates",
+// the best negotiated encoding is used instead.
+//
+// Defaults to nil, the first candidate is selected.
+func WithEncodingChooser(chooser func(r *http.Request, candidates []string) string) Option {
+	return func(c *config) {
+		c.encodingChooser = chooser
+	}
+}
+
+// WithContentEncodingHeaderKey sets the header key which declares the applied encoding,
+// e.g. "X-Body-Encoding" for gateways which read it from a custom header.
+// The response writers write the encoding to that header
+// and the `ReadHandler` reads the request body's encoding from it.
+//
+// Defaults to "Content-Encoding".
+func WithContentEncodingHeaderKey(key string) Option {
+	return func(c *config) {
+		if key != "" {
+			c.contentEncodingHeaderKey = key
+		}
+	}
+}
+
+// WithPathPrefixes makes `WriteHandler` to compress only the responses
+// of requests whose URL path starts with one of the given "prefixes",
+// e.g. "/api/" and "/static/". The rest of the requests are passed through.
+//
+// Defaults to nil, responses of all paths are compressed.
+func WithPathPrefixes(prefixes ...string) Option {
+	return func(c *config) {
+		c.pathPrefixes = append(c.pathPrefixes, prefixes...)
+	}
+}
+
+// WithExcludedPathPrefixes makes `WriteHandler` to pass through
+// the requests whose URL path starts with one of the given "prefixes",
+// e.g. "/health". It takes precedence over `WithPathPrefixes`.
+//
+// Defaults to nil, no path is excluded.
+func WithExcludedPathPrefixes(prefixes ...string) Option {
+	return func(c *config) {
+		c.excludedPathPrefixes = append(c.excludedPathPrefixes, prefixes...)
+	}
+}
+
+// WithSkipExtensions makes `WriteHandler` to pass through the requests
+// whose URL path ends with one of the given file "extensions", e.g. ".map" and ".wasm",
+// so they are served uncompressed. Extensions are compared case-insensitively
+// and the leading dot is optional.
+//
+// Defaults to nil, no extension is skipped.
+func WithSkipExtensions(extensions ...string) Option {
+	return func(c *config) {
+		for _, ext := range extensions {
+			if ext == "" {
+				continue
+			}
+			if ext[0] != '.' {
+				ext = "." + ext
+			}
+			c.skipExtensions = append(c.skipExtensions, ext)
+		}
+	}
+}
+
+// compressPath reports whether the responses of the "urlPath" should be compressed,
+// see `WithPathPrefixes`, `WithExcludedPathPrefixes` and `WithSkipExtensions`.
+func (c *config) compressPath(urlPath string) bool {
+	if len(c.skipExtensions) > 0 {
+		ext := path.Ext(urlPath)
+		for _, skip := range c.skipExtensions {
+			if strings.EqualFold(ext, skip) {
+				return false
+			}
+		}
+	}
+
+	for _, prefix := range c.excludedPathPrefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return false
+		}
+	}
+
+	if len(c.pathPrefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range c.pathPrefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WithTrustedForwardedAcceptEncoding makes the negotiation to read the original client's
+// accepted encodings from the "headerKey" header, e.g. "X-Forwarded-Accept-Encoding",
+// set by a proxy which does not pass the Accept-Encoding header through.
+// The forwarded header is used only when the request has no Accept-Encoding header
+// and it comes directly from one of the "trustedCIDRs", e.g. "10.0.0.0/8".
+// When the header appears more than once, the first one,
+// set by the proxy closest to the client, is used.
+//
+// It panics if a CIDR is invalid.
+func WithTrustedForwardedAcceptEncoding(headerKey string, trustedCIDRs ...string) Option {
+	trustedProxies := make([]*net.IPNet, 0, len(trustedCIDRs))
+	for _, cidr := range trustedCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic("compress: WithTrustedForwardedAcceptEncoding: " + err.Error())
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+
+	return func(c *config) {
+		c.forwardedAcceptEncodingKey = headerKey
+		c.trustedProxies = trustedProxies
+	}
+}
+
+// trustedProxy reports whether the "remoteAddr", e.g. "10.0.0.1:4242",
+// belongs to one of the trusted proxies, see `WithTrustedForwardedAcceptEncoding`.
+func (c *config) trustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range c.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WithDefaultEncodingWhenAbsent makes the negotiation to treat a request
+// without an Accept-Encoding header as if it accepts the given "encoding", e.g. "gzip",
+// for internal clients which never send the header but can decode the encoding.
+//
+// Defaults to empty, following RFC 7231, requests without
+// an Accept-Encoding header are served uncompressed.
+func WithDefaultEncodingWhenAbsent(encoding string) Option {
+	return func(c *config) {
+		c.defaultEncoding = encoding
+	}
+}
+
+// WithUserAgentFilter registers a function which is consulted, with the request's
+// User-Agent, before the response encoding is negotiated. It is a compatibility shim
+// for known clients, e.g. bots or proxies, which mishandle some encodings.
+//
+// If "allowEncoding" is false, or "forceEncoding" is "identity",
+// the response is not compressed.
+// If "forceEncoding" is a registered encoding and the client accepts it,
+// it is used instead of the negotiated one, and it is not re-negotiated
+// by the `WithContentLengthHint` or the `WithS2Upgrade` either.
+// Otherwise the negotiation continues as usual.
+//
+// Defaults to nil, all user agents are negotiated the same way.
+func WithUserAgentFilter(filter func(ua string) (allowEncoding bool, forceEncoding string)) Option {
+	return func(c *config) {
+		c.userAgentFilter = filter
+	}
+}
+
+// WithUnsupportedEncodingHandler sets the handler which is executed by `ReadHandler`
+// when the request body is compressed using an encoding the server does not support.
+// A nil handler passes the request through to the next handler
+// with its body left as it is, still compressed.
+//
+// Defaults to a handler which responds with 415 Unsupported Media Type.
+func WithUnsupportedEncodingHandler(h http.Handler) Option {
+	return func(c *config) {
+		c.unsupportedEncodingHandler = h
+	}
+}
+
+func unsupportedEncoding(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+}
+
+// WithAdaptiveLevel enables the adaptive compression level mode
+// of the response writer for the "gzip" and "deflate" encodings,
+// the rest of the encodings are not affected.
+// The level starts fast and adapts to the observed compression ratio,
+// see `NewAdaptiveWriter` for details. The response writer's Level field
+// reports the starting level.
+//
+// It is useful for sustained streaming responses of unknown content.
+func WithAdaptiveLevel() Option {
+	return func(c *config) {
+		c.adaptiveLevel = true
+	}
+}
+
+// WithIdentityFallback makes `NewResponseWriter` to return an identity response writer,
+// see `NewIdentityResponseWriter`, instead of an error when the response
+// cannot be compressed, e.g. the request has no Accept-Encoding header
+// or the client accepts none of the server's encodings.
+// That way handlers can always use the *ResponseWriter API,
+// whether compression happened or not.
+func WithIdentityFallback() Option {
+	return func(c *config) {
+		c.identityFallback = true
+	}
+}
+
+// WithReadAheadLimit bounds the compressed data a reader reads ahead from its source.
+// Each read from the source is at most "n" bytes and it happens only when
+// the decoder needs more input to serve the downstream reads.
+// It caps the memory used when a decompressed stream is proxied to a slow client.
+//
+// Applicability per encoding:
+//   - gzip and deflate: the input buffering is bounded to "n" bytes (16 at minimum).
+//     The decoder still keeps its 32KB window of decompressed data.
+//   - brotli: each read from the source is at most "n" bytes. The decoder still keeps
+//     its window of decompressed data, up to 16MB depending on the encoder's settings.
+//   - snappy and s2: each read from the source is at most "n" bytes,
+//     however a whole stream block must be buffered before it is decoded,
+//     up to 64KB for snappy and 4MB for s2.
+//
+// Defaults to 0, no limit.
+func WithReadAheadLimit(n int) Option {
+	return func(c *config) {
+		c.readAheadLimit = n
+	}
+}
+
+// WithStrictAcceptEncoding makes `WriteHandler` to respond with 400 Bad Request
+// when the request's Accept-Encoding header is malformed,
+// see `ValidateAcceptEncoding`.
+//
+// Defaults to false, invalid specs are skipped and the response
+// is served using the best encoding of the valid ones, if any.
+func WithStrictAcceptEncoding() Option {
+	return func(c *config) {
+		c.strictAcceptEncoding = true
+	}
+}
+
+// defaultMaxAcceptSpecs is the default limit of `WithMaxAcceptSpecs`.
+const defaultMaxAcceptSpecs = 32
+
+// WithMaxAcceptSpecs sets the maximum number of specs parsed from the Accept-Encoding
+// header values of a request, invalid ones included, the rest are ignored and the encoding
+// is negotiated among the parsed ones. It bounds the negotiation's CPU and memory
+// usage on enormous headers. A zero or negative "n" disables the limit.
+//
+// Defaults to 32.
+func WithMaxAcceptSpecs(n int) Option {
+	return func(c *config) {
+		c.maxAcceptSpecs = n
+	}
+}
+
+// acceptSpecsLimit returns the `WithMaxAcceptSpecs` limit,
+// the default one for a nil config, e.g. of `GetEncoding`.
+func (c *config) acceptSpecsLimit() int {
+	if c == nil {
+		return defaultMaxAcceptSpecs
+	}
+
+	return c.maxAcceptSpecs
+}
+
+// WithContentLengthHint makes the response writer to consult the "Content-Length" header,
+// when it is set by the handler before the first write, to decide upfront
+// whether and how the response should be compressed:
+//   - a response smaller than "minSize" is not compressed at all,
+//     it is sent as it is with its "Content-Length".
+//   - a response of "largeSize" or larger is compressed with a fast encoding,
+//     "s2" or "snappy", if the client accepts one of them.
+//     A zero or negative "largeSize" disables this rule.
+//   - any other response is compressed with "br" (brotli), if the client accepts it,
+//     as it gives the best ratio for medium sizes.
+//
+// In any other case, e.g. the client accepts none of the preferred encodings
+// or the response size is unknown, the negotiated encoding is kept.
+// An encoding chosen by the `WithEncodingChooser` or forced by the `WithUserAgentFilter`
+// is kept too, only the "minSize" rule applies to it.
+func WithContentLengthHint(minSize, largeSize int64) Option {
+	return func(c *config) {
+		c.contentLengthHint = true
+		c.minContentLength = minSize
+		c.largeContentLength = largeSize
+	}
+}
+
+// WithS2Upgrade makes the response writer to upgrade a "snappy" response to "s2"
+// when its size is "minSize" bytes or larger, as s2 compresses large data
+// faster and better. The size is known through the "Content-Length" header,
+// set by the handler before the first write, or, on `WithStreamingThreshold`,
+// through the data buffered until the threshold is reached.
+//
+// Compatibility: s2 decoders read snappy streams but snappy decoders
+// cannot read s2 streams, so the upgrade happens only if the client lists "s2"
+// explicitly on its Accept-Encoding header, e.g. "snappy, s2".
+// A wildcard ("*") does not include it, as s2 is not one of the `DefaultOffers`.
+// A "snappy" encoding chosen by the `WithEncodingChooser`
+// or forced by the `WithUserAgentFilter` is not upgraded.
+//
+// Defaults to 0, snappy responses are never upgraded.
+func WithS2Upgrade(minSize int64) Option {
+	return func(c *config) {
+		c.s2UpgradeSize = minSize
+	}
+}
+
+// WithStreamingThreshold makes the response writer to compress a response
+// only when its size reaches "n" bytes, for streaming responses of unknown size.
+// The response is buffered, up to "n" bytes, until the decision is made:
+//   - once "n" bytes are written, the buffered data and all subsequent writes
+//     are compressed, the response is compressed from its start.
+//   - if the handler completes before that, the response is sent as it is,
+//     along with its "Content-Length".
+//   - if the handler flushes before that, the response is sent as it is,
+//     so the data flushed so far reach the client without delay.
+//
+// When the handler sets the "Content-Length" header before the first write,
+// the decision is made upfront, without buffering.
+//
+// Defaults to 0, responses are compressed from the first write.
+func WithStreamingThreshold(n int64) Option {
+	return func(c *config) {
+		c.streamingThreshold = n
+	}
+}
+
+// WithFullBuffering makes the response writer to buffer the whole compressed response,
+// up to "maxSize" compressed bytes, and send it on Close, in one shot,
+// along with its accurate "Content-Length" header instead of a chunked body.
+// If the compressed response exceeds the "maxSize", the buffered data are sent
+// and the rest of the response is streamed, without a "Content-Length".
+//
+// While the response is buffered, flushes do not reach the client.
+// Responses which are not compressed are not buffered.
+//
+// Defaults to 0, the compressed data are streamed as they are written.
+func WithFullBuffering(maxSize int) Option {
+	return func(c *config) {
+		c.fullBufferingSize = maxSize
+	}
+}
+
+// WithWriteDeadline makes the response writer to set the connection's write deadline
+// to "d" from now before each write and flush of compressed data to the client,
+// so a slow client cannot block the handler indefinitely.
+// A write which exceeds the deadline returns the net timeout error
+// and the `WriteHandler` aborts the response, by panicking with http.ErrAbortHandler
+// once the handler returns, the server closes the connection.
+//
+// The deadline is set through the `SetWriteDeadline` method of the response writer,
+// or of the first one which has it through its Unwrap chain, as http.ResponseController does.
+// Response writers which do not support deadlines are written without one.
+// Note that the response writer of the net/http server has a SetWriteDeadline method
+// since Go 1.20, on earlier Go versions, the module supports Go 1.19,
+// this option has no effect unless a custom response writer implements it.
+//
+// Defaults to 0, no write deadline is set.
+func WithWriteDeadline(d time.Duration) Option {
+	return func(c *config) {
+		c.writeDeadline = d
+	}
+}
+
+// WithResponseCache enables an in-memory, least recently used, cache
+// of compressed responses. A GET response with a 200 status code and a strong
+// "ETag" header, e.g. "v1" but not W/"v1", is cached, once complete,
+// per host, path, query, ETag and encoding. A later response of the same key
+// is served from the cache: the handler still runs but the data it writes
+// are discarded instead of compressed, and the cached data are sent
+// along with their "Content-Length" header.
+// Use it only for handlers which serve byte-identical bodies for the same strong ETag.
+//
+// The "size" is the maximum total size, in bytes, of the cached compressed data,
+// the least recently used responses are evicted to stay within it.
+// Each response in progress holds up to "size" bytes too,
+// larger responses are not recorded and not cached.
+// There is no explicit invalidation: a changed resource is served with a new ETag,
+// its stale entries are never served again and they are evicted eventually.
+//
+// The cache is created once, it is shared by all the handlers
+// (and `ServeReader` calls) the returned Option is passed to.
+// Defaults to 0, no caching.
+func WithResponseCache(size int) Option {
+	var cache *responseCache
+	if size > 0 {
+		cache = newResponseCache(size)
+	}
+
+	return func(c *config) {
+		c.responseCache = cache
+	}
+}
+
+// WithStrictNegotiation makes `WriteHandler` to respond with 406 Not Acceptable,
+// see `WriteNotAcceptable`, when the client accepts none of the server's encodings
+// and it explicitly refuses the "identity" one too,
+// e.g. "Accept-Encoding: zstd, identity;q=0".
+// `NewResponseWriter` returns `ErrNotAcceptable` in that case.
+//
+// Defaults to false, the response is sent uncompressed.
+func WithStrictNegotiation() Option {
+	return func(c *config) {
+		c.strictNegotiation = true
+	}
+}
+
+// WithSkipChecksumVerification makes the readers of the "gzip" encoding
+// to skip the verification of the CRC-32 and size trailer of the data,
+// which saves the checksum calculation on large bodies.
+// It applies to the builtin gzip decoder only.
+//
+// Safety tradeoff: the trailer is the only integrity check of a gzip stream,
+// without it corrupted or truncated-at-a-block-boundary data are not detected.
+// Enable it only for trusted traffic, e.g. between internal services,
+// when the transport already guarantees the integrity of the data.
+//
+// Defaults to false, the trailer is verified.
+func WithSkipChecksumVerification() Option {
+	return func(c *config) {
+		c.skipChecksumVerification = true
+	}
+}
+
+// WithBrotliWindow sets the base 2 logarithm of the brotli encoder's sliding window size,
+// "lgwin" ranges from 10 to 24. A larger window may improve the ratio of large,
+// repetitive, responses at the cost of memory, on both the server and the client.
+// It applies to the brotli writers only.
+//
+// Note that the brotli encoder's mode hint (generic, text or font)
+// is not configurable: the encoder detects UTF-8 text input by itself
+// and uses the text-optimized context modeling for it, e.g. for HTML and JSON.
+//
+// Defaults to 0, the window size is selected automatically based on the level.
+func WithBrotliWindow(lgwin int) Option {
+	return func(c *config) {
+		c.writer.brotliLGWin = lgwin
+	}
+}
+
+// WithReproducibleGzip makes the gzip writers write a fixed header,
+// of no modification time and an unknown OS, so the output is byte-identical
+// for the same input and level, e.g. for content-addressed caching.
+// It applies to the gzip writers only, the rest of the encodings
+// do not embed such metadata.
+//
+// Defaults to false.
+func WithReproducibleGzip() Option {
+	return func(c *config) {
+		c.writer.reproducibleGzip = true
+	}
+}
+
+// WithMaxDecompressedSize limits the size of the decompressed data a reader returns,
+// it protects the server from compressed bodies which expand to huge sizes ("zip bombs").
+// Reads beyond the limit fail with a `BodyTooLargeError`
+// which wraps the `ErrDecompressedBodyTooLarge`.
+//
+// It bounds the decompressed size, to bound the compressed size as well
+// wrap the request body with an `http.MaxBytesReader` before the `ReadHandler`.
+//
+// Defaults to 0, no limit.
+func WithMaxDecompressedSize(n int64) Option {
+	return func(c *config) {
+		c.maxDecompressedSize = n
+	}
+}
+
+// WithSeekableBody makes the readers to decompress the whole body upfront,
+// up to "maxBuffer" bytes, and keep it in memory, so the Reader's Seekable
+// returns a `SeekableReader` which can rewind it, e.g. for frameworks
+// which seek the request body to 0 in order to read it again.
+// The `ReadHandler` sets the request body to that SeekableReader.
+// Bodies larger than "maxBuffer" are decompressed as they are read,
+// their Seekable returns `ErrBodyNotSeekable` and the request body is not an io.Seeker.
+//
+// Note that the body is decompressed when the reader is created,
+// e.g. by the `ReadHandler` before the next handler is executed,
+// so decompression errors are reported by the reader's creation.
+//
+// Defaults to 0, the body is decompressed as it is read and it is not seekable.
+func WithSeekableBody(maxBuffer int) Option {
+	return func(c *config) {
+		c.seekableBodyBuffer = maxBuffer
+	}
+}
+
+// WithErrorHandler registers a function which is called by `ReadHandler`
+// when the request body cannot be decompressed, e.g. it has an invalid gzip header.
+// The function is responsible to write the response, the next handler is not executed.
+// It is not called for the response errors of `WriteHandler`: the errors of closing
+// a compressed response, e.g. a truncated response on a broken pipe,
+// are reported only to the `WithCloseErrorHandler`, which should be set as well
+// to log them.
+//
+// Defaults to nil, the request is passed through to the next handler
+// with its body left as it is.
+func WithErrorHandler(errorHandler func(w http.ResponseWriter, r *http.Request, err error)) Option {
+	return func(c *config) {
+		c.errorHandler = errorHandler
+	}
+}
+
+// WithCloseErrorHandler registers a function which is called by `WriteHandler`,
+// with a `CloseError`, when the compressed response cannot be finalized,
+// e.g. on a broken pipe, so truncated responses can be logged.
+// The response is already sent at that point, so the function is not given
+// the response writer.
+//
+// Defaults to nil, the response close errors are discarded.
+func WithCloseErrorHandler(closeErrorHandler func(r *http.Request, err error)) Option {
+	return func(c *config) {
+		c.closeErrorHandler = closeErrorHandler
+	}
+}
+
+// WithRequestEncodingSniffing makes `ReadHandler` to detect the encoding
+// of request bodies sent without a "Content-Encoding" header,
+// by their signature. Only the encodings with a signature are detected:
+// "gzip", "snappy" and "s2" (framed) streams.
+//
+// Defaults to false, request bodies without a "Content-Encoding" header are read as they are.
+func WithRequestEncodingSniffing() Option {
+	return func(c *config) {
+		c.sniffRequestEncoding = true
+	}
+}
+
+// defaultMaxMessageSize is the default limit of `WithMaxMessageSize`.
+const defaultMaxMessageSize = 4 << 20
+
+// WithMaxMessageSize sets the maximum size of a message the `MessageStreamReader` accepts,
+// larger length prefixes fail with `ErrMessageTooLarge`,
+// so a corrupted or malicious stream cannot make it allocate arbitrary memory.
+// It limits the decompressed messages of the `PerMessageDeflateReader` too.
+// A zero or negative "n" disables the limit.
+//
+// Defaults to 4MB.
+func WithMaxMessageSize(n int) Option {
+	return func(c *config) {
+		c.maxMessageSize = n
+	}
+}
@@ -0,0 +1,148 @@
+package compress
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// expectPathEncodings fails the test if the responses of the "h"
+// to the paths of "expected" are not encoded using their encodings.
+func expectPathEncodings(t *testing.T, h http.Handler, expected map[string]string) {
+	t.Helper()
+
+	for urlPath, encoding := range expected {
+		r := httptest.NewRequest(http.MethodGet, urlPath, nil)
+		r.Header.Set(AcceptEncodingHeaderKey, GZIP)
+		rec := serve(h, r)
+		if got := rec.Header().Get(ContentEncodingHeaderKey); got != encoding {
+			t.Fatalf("%s: expected encoding %q but got %q", urlPath, encoding, got)
+		}
+		expectResponse(t, rec, encoding, testBody)
+	}
+}
+
+func TestPathPrefixes(t *testing.T) {
+	h := WriteHandler(http.HandlerFunc(writeTestBody),
+		WithPathPrefixes("/api/", "/static/"), WithExcludedPathPrefixes("/api/internal/"))
+
+	expectPathEncodings(t, h, map[string]string{
+		"/api/x":          GZIP,
+		"/static/app.css": GZIP,
+		"/health":         "",
+		"/":               "",
+		"/api/internal/x": "",
+	})
+}
+
+func TestTrustedForwardedAcceptEncoding(t *testing.T) {
+	const key = "X-Forwarded-Accept-Encoding"
+
+	h := WriteHandler(http.HandlerFunc(writeTestBody),
+		WithTrustedForwardedAcceptEncoding(key, "10.0.0.0/8"))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		direct     string
+		forwarded  []string
+		encoding   string
+		vary       string
+	}{
+		{"trusted", "10.0.0.1:4242", "", []string{"br"}, BROTLI, "Accept-Encoding, X-Forwarded-Accept-Encoding"},
+		{"proxy chain", "10.1.2.3:4242", "", []string{"gzip", "br"}, GZIP, "Accept-Encoding, X-Forwarded-Accept-Encoding"},
+		{"untrusted", "192.168.1.1:4242", "", []string{"br"}, "", ""},
+		{"direct", "10.0.0.1:4242", "gzip", []string{"br"}, GZIP, "Accept-Encoding"},
+	}
+
+	for _, tt := range tests {
+		r := newTestRequest(tt.direct)
+		r.RemoteAddr = tt.remoteAddr
+		for _, value := range tt.forwarded {
+			r.Header.Add(key, value)
+		}
+
+		rec := serve(h, r)
+		expectResponse(t, rec, tt.encoding, testBody)
+		if got := strings.Join(rec.Header().Values(VaryHeaderKey), ", "); got != tt.vary {
+			t.Fatalf("%s: expected Vary: %s but got %s", tt.name, tt.vary, got)
+		}
+	}
+}
+
+func TestDefaultEncodingWhenAbsent(t *testing.T) {
+	h := WriteHandler(http.HandlerFunc(writeTestBody), WithDefaultEncodingWhenAbsent(GZIP))
+
+	expectResponse(t, serve(h, newTestRequest("")), GZIP, testBody)
+	// The header, when present, is negotiated as usual.
+	expectResponse(t, serve(h, newTestRequest(BROTLI)), BROTLI, testBody)
+	expectResponse(t, serve(h, newTestRequest(IDENTITY)), "", testBody)
+
+	// Off by default.
+	expectResponse(t, serve(WriteHandler(http.HandlerFunc(writeTestBody)), newTestRequest("")), "", testBody)
+}
+
+func TestSkipExtensions(t *testing.T) {
+	h := WriteHandler(http.HandlerFunc(writeTestBody), WithSkipExtensions(".map", "WASM"))
+
+	expectPathEncodings(t, h, map[string]string{
+		"/app.js":          GZIP,
+		"/app.js.map":      "",
+		"/static/APP.MAP":  "",
+		"/module.wasm":     "",
+		"/map":             GZIP,
+		"/app.js.map.html": GZIP,
+	})
+}
+
+func TestOptionsOverride(t *testing.T) {
+	base := Options(WithLevel(5), WithOffers(GZIP, BROTLI), WithPathPrefixes("/api/"), WithBrotliWindow(20))
+
+	expectBase := func(name string, c *config, level int) {
+		t.Helper()
+
+		if c.level != level {
+			t.Fatalf("%s: expected level %d but got %d", name, level, c.level)
+		}
+		if !reflect.DeepEqual(c.offers, []string{GZIP, BROTLI}) {
+			t.Fatalf("%s: expected the base offers but got %v", name, c.offers)
+		}
+		if !reflect.DeepEqual(c.pathPrefixes, []string{"/api/"}) {
+			t.Fatalf("%s: expected the base path prefixes but got %v", name, c.pathPrefixes)
+		}
+		if c.writer != (writerOptions{brotliLGWin: 20}) {
+			t.Fatalf("%s: expected the base writer options but got %+v", name, c.writer)
+		}
+	}
+
+	expectBase("base", newConfig([]Option{base}), 5)
+	expectBase("override", newConfig([]Option{base, WithLevel(1)}), 1)
+	// The later option wins.
+	expectBase("base override", newConfig([]Option{WithLevel(1), base}), 5)
+	// The base options are not mutated by an override.
+	expectBase("base again", newConfig([]Option{base}), 5)
+
+	// Through handlers which share the base options.
+	levels := make(map[string]int)
+	record := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			levels[name] = w.(*ResponseWriter).Level
+			writeTestBody(w, r)
+		})
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", WriteHandler(record("api"), base))
+	mux.Handle("/api/logs", WriteHandler(record("logs"), base, WithLevel(1)))
+	for _, urlPath := range []string{"/api/x", "/api/logs", "/api/y"} {
+		r := httptest.NewRequest(http.MethodGet, urlPath, nil)
+		r.Header.Set(AcceptEncodingHeaderKey, GZIP)
+		expectResponse(t, serve(mux, r), GZIP, testBody)
+	}
+
+	if expected := map[string]int{"api": 5, "logs": 1}; !reflect.DeepEqual(levels, expected) {
+		t.Fatalf("expected levels %v but got %v", expected, levels)
+	}
+}
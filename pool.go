@@ -0,0 +1,92 @@
+package compress
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Compress compresses the "data" using the given "encoding" and "level"
+// and returns a new slice of the compressed bytes.
+//
+// Buffers and writers are pooled internally,
+// so repeated calls, e.g. from a cache layer, allocate minimally.
+func Compress(encoding string, level int, data []byte) ([]byte, error) {
+	buf := acquireBuffer()
+	defer releaseBuffer(buf)
+
+	cw, err := acquireWriter(buf, encoding, level, writerOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = cw.Write(data); err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	releaseWriter(cw, encoding, level, writerOptions{})
+
+	// The buffer is recycled, return a copy.
+	compressed := make([]byte, buf.Len())
+	copy(compressed, buf.Bytes())
+	return compressed, nil
+}
+
+// maxPooledBufferSize is the maximum capacity of a buffer to be pooled,
+// larger buffers are left to the garbage collector
+// so a few big payloads do not keep memory reserved.
+const maxPooledBufferSize = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func acquireBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func releaseBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+type writerPoolKey struct {
+	encoding string
+	level    int
+	options  writerOptions
+}
+
+// writerPools holds a *sync.Pool of Writers per writerPoolKey.
+var writerPools sync.Map
+
+// acquireWriter returns a pooled Writer of "w", or a new one,
+// based on the given "encoding", "level" and writer options.
+func acquireWriter(w io.Writer, encoding string, level int, wo writerOptions) (Writer, error) {
+	level = normalizeLevel(encoding, level)
+
+	if p, ok := writerPools.Load(writerPoolKey{encoding, level, wo}); ok {
+		if cw, ok := p.(*sync.Pool).Get().(Writer); ok {
+			cw.Reset(w)
+			return cw, nil
+		}
+	}
+
+	return newWriter(w, encoding, level, wo)
+}
+
+// releaseWriter puts back a Writer, acquired by acquireWriter, to its pool.
+// The Writer must be closed and its output fully written.
+func releaseWriter(cw Writer, encoding string, level int, wo writerOptions) {
+	level = normalizeLevel(encoding, level)
+
+	p, _ := writerPools.LoadOrStore(writerPoolKey{encoding, level, wo}, new(sync.Pool))
+	p.(*sync.Pool).Put(cw)
+}
@@ -0,0 +1,50 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	for _, encoding := range []string{GZIP, DEFLATE, BROTLI, SNAPPY, S2} {
+		first, err := Compress(encoding, DefaultCompression, []byte(testBody))
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		snapshot := append([]byte(nil), first...)
+
+		// The buffer is recycled, the returned data must not change.
+		if _, err = Compress(encoding, DefaultCompression, []byte("other data")); err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if !bytes.Equal(first, snapshot) {
+			t.Fatalf("%s: the compressed data were modified by a later call", encoding)
+		}
+
+		if got := decompress(t, encoding, first); string(got) != testBody {
+			t.Fatalf("%s: expected the original data but got %q", encoding, got)
+		}
+	}
+
+	if _, err := Compress("zstd", DefaultCompression, nil); !errors.Is(err, ErrNotSupportedCompression) {
+		t.Fatalf("expected ErrNotSupportedCompression but got %v", err)
+	}
+}
+
+// BenchmarkCompress measures the allocations of compressing small cache values,
+// run it with -benchtime=100000x for 100k calls.
+func BenchmarkCompress(b *testing.B) {
+	value := []byte(`{"id":42,"name":"compress","tags":["gzip","deflate","br"]}`)
+
+	for _, encoding := range []string{GZIP, BROTLI, SNAPPY} {
+		b.Run(encoding, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Compress(encoding, DefaultCompression, value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
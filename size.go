@@ -0,0 +1,92 @@
+package compress
+
+import (
+	"strconv"
+	"strings"
+)
+
+// applyContentLengthHint selects the encoding of the response,
+// before anything is written, based on its known size.
+// See `WithContentLengthHint`.
+func (w *ResponseWriter) applyContentLengthHint() {
+	h := w.Header()
+	size, err := strconv.ParseInt(h.Get(ContentLengthHeaderKey), 10, 64)
+	if err != nil || size < 0 {
+		return
+	}
+
+	if size < w.config.minContentLength {
+		w.dropEncoding()
+		return
+	}
+
+	if w.encodingChosen {
+		// The encoding was chosen on purpose, it is not re-negotiated.
+		return
+	}
+
+	preferred := []string{BROTLI}
+	if w.config.largeContentLength > 0 && size >= w.config.largeContentLength {
+		preferred = []string{S2, SNAPPY}
+	}
+
+	candidates := acceptedOffers(w.acceptEncoding, w.config.encodingOffers(), w.config.maxAcceptSpecs)
+	for _, encoding := range preferred {
+		for _, candidate := range candidates {
+			if candidate != encoding {
+				continue
+			}
+
+			w.switchEncoding(encoding)
+			return
+		}
+	}
+}
+
+// applyS2Upgrade upgrades a "snappy" response to "s2",
+// when its size is at least the configured one and the client accepts "s2".
+// See `WithS2Upgrade`.
+func (w *ResponseWriter) applyS2Upgrade() {
+	size, err := strconv.ParseInt(w.Header().Get(ContentLengthHeaderKey), 10, 64)
+	if err != nil || size < 0 {
+		if w.pending == nil {
+			return
+		}
+		// The size is unknown but at least the buffered data, see `WithStreamingThreshold`.
+		size = int64(w.pending.Len())
+	}
+
+	if size < w.config.s2UpgradeSize {
+		return
+	}
+
+	// S2 is not a standard offer, a wildcard does not include it.
+	for _, spec := range parseAccept(w.acceptEncoding, w.config.maxAcceptSpecs) {
+		if spec.Q > 0 && strings.EqualFold(spec.Value, S2) {
+			w.switchEncoding(S2)
+			return
+		}
+	}
+}
+
+// switchEncoding replaces the compressor of the response writer
+// with one of the given "encoding". Nothing must be written by the previous one yet.
+func (w *ResponseWriter) switchEncoding(encoding string) {
+	if encoding == w.Encoding {
+		return
+	}
+
+	level := normalizeLevel(encoding, w.level)
+	cw, err := acquireWriter(w.output(), encoding, level, w.config.writer)
+	if err != nil {
+		return
+	}
+
+	// Nothing was written by the previous writer yet, it is just dropped.
+	w.releasePooledWriter()
+	w.pooledWriter = cw
+	w.Writer = cw
+	w.Encoding = encoding
+	w.Level = level
+	addCompressHeaders(w.Header(), w.contentEncodingHeaderKey(), encoding)
+}
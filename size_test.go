@@ -0,0 +1,117 @@
+package compress
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestContentLengthHint(t *testing.T) {
+	small := strings.Repeat("a", 50)
+	medium := testBody
+	large := strings.Repeat(testBody, 20)
+
+	tests := []struct {
+		name           string
+		body           string
+		acceptEncoding string
+		expected       string
+	}{
+		{"small", small, "gzip, br", ""},
+		{"medium", medium, "gzip, br, snappy", BROTLI},
+		{"medium without brotli", medium, "gzip, snappy", GZIP},
+		{"large", large, "gzip, br, snappy", SNAPPY},
+		{"large s2", large, "gzip, br, s2, snappy", S2},
+		{"large without fast encodings", large, "gzip, br", GZIP},
+	}
+
+	for _, tt := range tests {
+		h := WriteHandler(testHandler{body: tt.body, contentLength: true},
+			WithContentLengthHint(100, 64<<10), WithOffers(GZIP, BROTLI, SNAPPY, S2))
+		rec := serve(h, newTestRequest(tt.acceptEncoding))
+		if got := rec.Header().Get(ContentEncodingHeaderKey); got != tt.expected {
+			t.Fatalf("%s: expected encoding %q but got %q", tt.name, tt.expected, got)
+		}
+		expectResponse(t, rec, tt.expected, tt.body)
+
+		// The Content-Length is kept only for the uncompressed response.
+		if got, expected := rec.Header().Get(ContentLengthHeaderKey) != "", tt.expected == ""; got != expected {
+			t.Fatalf("%s: expected Content-Length header presence %v but got %v", tt.name, expected, got)
+		}
+	}
+}
+
+func TestContentLengthHintEncodingChooser(t *testing.T) {
+	body := strings.Repeat("a", 5000)
+	h := WriteHandler(testHandler{body: body, contentLength: true}, WithContentLengthHint(100, 0), WithEncodingChooser(func(r *http.Request, candidates []string) string {
+		return GZIP
+	}))
+
+	// The chosen encoding is kept, it is not re-negotiated to brotli.
+	expectResponse(t, serve(h, newTestRequest("gzip, br")), GZIP, body)
+}
+
+func TestContentLengthHintUserAgentFilter(t *testing.T) {
+	body := strings.Repeat("a", 5000)
+	writeBody := testHandler{body: body, contentLength: true}
+	filter := WithUserAgentFilter(func(ua string) (bool, string) {
+		if strings.HasPrefix(ua, "legacy") {
+			return true, GZIP
+		}
+		return true, ""
+	})
+	chooser := WithEncodingChooser(func(r *http.Request, candidates []string) string {
+		return GZIP
+	})
+
+	tests := []struct {
+		name      string
+		h         http.Handler
+		userAgent string
+		expected  string
+	}{
+		{"forced", WriteHandler(writeBody, WithContentLengthHint(100, 0), filter), "legacy/1.0", GZIP},
+		{"not forced", WriteHandler(writeBody, WithContentLengthHint(100, 0), filter), "modern/1.0", BROTLI},
+		{"forced and chosen", WriteHandler(writeBody, WithContentLengthHint(100, 0), filter, chooser), "legacy/1.0", GZIP},
+	}
+
+	for _, tt := range tests {
+		r := newTestRequest("gzip, br")
+		r.Header.Set(UserAgentHeaderKey, tt.userAgent)
+		rec := serve(tt.h, r)
+		if got := rec.Header().Get(ContentEncodingHeaderKey); got != tt.expected {
+			t.Fatalf("%s: expected encoding %q but got %q", tt.name, tt.expected, got)
+		}
+		expectResponse(t, rec, tt.expected, body)
+	}
+}
+
+func TestS2Upgrade(t *testing.T) {
+	small := strings.Repeat("a", 500)
+	large := testBody
+	upgrade := []Option{WithOffers(SNAPPY), WithS2Upgrade(1000)}
+
+	tests := []struct {
+		name           string
+		h              http.Handler
+		body           string
+		acceptEncoding string
+		expected       string
+	}{
+		{"small", WriteHandler(testHandler{body: small, contentLength: true}, upgrade...), small, "snappy, s2", SNAPPY},
+		{"large", WriteHandler(testHandler{body: large, contentLength: true}, upgrade...), large, "snappy, s2", S2},
+		{"large without s2", WriteHandler(testHandler{body: large, contentLength: true}, upgrade...), large, "snappy", SNAPPY},
+		{"large wildcard", WriteHandler(testHandler{body: large, contentLength: true}, upgrade...), large, "snappy, *", SNAPPY},
+		{"large refused s2", WriteHandler(testHandler{body: large, contentLength: true}, upgrade...), large, "snappy, s2;q=0", SNAPPY},
+		{"unknown size", WriteHandler(testHandler{body: large}, upgrade...), large, "snappy, s2", SNAPPY},
+		{"buffered", WriteHandler(testHandler{body: large}, append(upgrade, WithStreamingThreshold(2000))...), large, "snappy, s2", S2},
+	}
+
+	for _, tt := range tests {
+		rec := serve(tt.h, newTestRequest(tt.acceptEncoding))
+		if got := rec.Header().Get(ContentEncodingHeaderKey); got != tt.expected {
+			t.Fatalf("%s: expected encoding %q but got %q", tt.name, tt.expected, got)
+		}
+		expectResponse(t, rec, tt.expected, tt.body)
+	}
+}
@@ -0,0 +1,42 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// encodingSignatures are the magic bytes a compressed stream starts with.
+var encodingSignatures = []struct {
+	encoding string
+	magic    []byte
+}{
+	{GZIP, []byte{0x1f, 0x8b, 0x08}},
+	{SNAPPY, []byte("\xff\x06\x00\x00sNaPpY")},
+	{S2, []byte("\xff\x06\x00\x00S2sTwO")},
+}
+
+// maxSignatureLength is the length of the longest encoding signature.
+const maxSignatureLength = 10
+
+// sniffEncoding detects the encoding of the "body" by its signature.
+// It returns an empty encoding if it is unknown and
+// the body to read from, as the signature bytes are peeked.
+func sniffEncoding(body io.ReadCloser) (string, io.ReadCloser) {
+	br := bufio.NewReader(body)
+	rc := &readCloser{Reader: br, Closer: body}
+
+	head, _ := br.Peek(maxSignatureLength)
+	for _, signature := range encodingSignatures {
+		if bytes.HasPrefix(head, signature.magic) {
+			return signature.encoding, rc
+		}
+	}
+
+	return "", rc
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
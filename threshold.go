@@ -0,0 +1,95 @@
+package compress
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// bufferWrite buffers the "p" until the response size reaches the streaming threshold,
+// then the response is compressed from its start. See `WithStreamingThreshold`.
+func (w *ResponseWriter) bufferWrite(p []byte) (int, error) {
+	if w.pendingStatus == 0 {
+		// An implicit WriteHeader, the handler may have set the "Content-Length" already.
+		w.bufferWriteHeader(http.StatusOK)
+		if !w.buffering {
+			return w.Write(p)
+		}
+	}
+
+	w.pending.Write(p)
+	w.written += int64(len(p))
+
+	if int64(w.pending.Len()) < w.config.streamingThreshold {
+		return len(p), nil
+	}
+
+	if err := w.commitPending(true); err != nil {
+		return 0, err
+	}
+
+	if w.AutoFlush {
+		return len(p), w.Writer.Flush()
+	}
+
+	return len(p), nil
+}
+
+// bufferWriteHeader records the status code of a buffered response.
+// If the size of the response is known, through its "Content-Length" header,
+// the encoding is decided right away.
+func (w *ResponseWriter) bufferWriteHeader(statusCode int) {
+	if w.pendingStatus == 0 {
+		w.pendingStatus = statusCode
+	}
+
+	size, err := strconv.ParseInt(w.Header().Get(ContentLengthHeaderKey), 10, 64)
+	if err != nil || size < 0 {
+		return
+	}
+
+	_ = w.commitPending(size >= w.config.streamingThreshold)
+}
+
+// commitPending ends the buffering state of the response writer:
+// it writes the header and the buffered data, compressed if "compress" is true,
+// otherwise as they are.
+func (w *ResponseWriter) commitPending(compress bool) error {
+	w.buffering = false
+	defer func() {
+		releaseBuffer(w.pending)
+		w.pending = nil
+	}()
+
+	if !compress {
+		w.dropEncoding()
+	}
+
+	statusCode := w.pendingStatus
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	w.WriteHeader(statusCode)
+
+	if w.pending.Len() == 0 {
+		return nil
+	}
+
+	_, err := w.Writer.Write(w.pending.Bytes())
+	return err
+}
+
+// dropEncoding makes the response writer to write the data as they are.
+// Nothing must be written by its compressor yet.
+func (w *ResponseWriter) dropEncoding() {
+	h, key := w.Header(), w.contentEncodingHeaderKey()
+	if h.Get(key) == w.Encoding {
+		h.Del(key)
+	}
+
+	// Nothing was written by the previous writer yet, it is just dropped.
+	w.releasePooledWriter()
+	w.dropBuffered()
+	w.Writer = &identityWriter{w.ResponseWriter}
+	w.Encoding = IDENTITY
+	w.Level = NoCompression
+}
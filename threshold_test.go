@@ -0,0 +1,52 @@
+package compress
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStreamingThreshold(t *testing.T) {
+	const threshold = 1000
+
+	chunk := strings.Repeat("a line of the stream\n", 5) // 105 bytes.
+
+	tests := []struct {
+		name          string
+		chunks        int
+		flush         bool
+		encoding      string
+		contentLength bool
+		setLength     bool
+	}{
+		// Crosses the threshold mid-way, on the 10th write.
+		{"above", 30, false, GZIP, false, false},
+		{"below", 5, false, "", true, false},
+		// Flushed before the threshold is reached.
+		{"flushed", 30, true, "", false, false},
+		// The Content-Length set by the handler decides on the first write, without a WriteHeader.
+		{"content length flushed", 30, true, GZIP, false, true},
+		{"content length below", 5, false, "", true, true},
+	}
+
+	for _, tt := range tests {
+		body := strings.Repeat(chunk, tt.chunks)
+		h := WriteHandler(testHandler{body: body, contentLength: tt.setLength, chunkSize: len(chunk), flush: tt.flush},
+			WithStreamingThreshold(threshold))
+		rec := serve(h, newTestRequest(GZIP))
+		expectResponse(t, rec, tt.encoding, body)
+
+		if tt.encoding != "" && !bytes.HasPrefix(rec.Body.Bytes(), []byte{0x1f, 0x8b}) {
+			t.Fatalf("%s: expected the response to be compressed from its start", tt.name)
+		}
+
+		expected := ""
+		if tt.contentLength {
+			expected = strconv.Itoa(len(body))
+		}
+		if got := rec.Header().Get(ContentLengthHeaderKey); got != expected {
+			t.Fatalf("%s: expected Content-Length %q but got %q", tt.name, expected, got)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package compress
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// deflateTail is the empty stored block a sync flush ends with,
+// RFC 7692 requires it to be stripped from the end of each compressed message.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// deflateFinalBlock is an empty, final, stored block.
+// It is appended to a message, after its tail, to terminate the deflate stream.
+var deflateFinalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// maxDeflateWindow is the deflate's LZ77 sliding window size (15 window bits).
+const maxDeflateWindow = 32 << 10
+
+// perMessageDeflateDefaultLevel is the level of the `DefaultCompression`
+// of a PerMessageDeflateWriter. It is the lowest level which references
+// the data of previous messages and which compresses small messages,
+// the faster levels store them as they are.
+const perMessageDeflateDefaultLevel = 7
+
+// PerMessageDeflateWriter compresses WebSocket messages following
+// the permessage-deflate extension of RFC 7692.
+// It is not safe for concurrent use.
+//
+// The compressor always uses a 15-bit (32KB) LZ77 window,
+// so the "client_max_window_bits" and "server_max_window_bits" extension parameters
+// should not be negotiated below 15 for this writer's side.
+type PerMessageDeflateWriter struct {
+	fw              *flate.Writer
+	buf             bytes.Buffer
+	contextTakeover bool
+}
+
+// NewPerMessageDeflateWriter returns a new permessage-deflate writer.
+// The "level" is the deflate compression level, see `DefaultCompression`.
+// When "contextTakeover" is false, the compressor is reset between messages,
+// as the "no_context_takeover" extension parameters require.
+//
+// The `DefaultCompression` of the writer is level 7. Note that levels 1 to 6
+// use fast encoders which neither reference the data of previous messages,
+// even on context takeover, nor compress small messages: a message of a few
+// hundred bytes is sent as a stored block, a bit larger than the message itself.
+// Use levels 7 to 9 for small messages.
+func NewPerMessageDeflateWriter(level int, contextTakeover bool) (*PerMessageDeflateWriter, error) {
+	if level == DefaultCompression {
+		level = perMessageDeflateDefaultLevel
+	}
+
+	w := &PerMessageDeflateWriter{contextTakeover: contextTakeover}
+
+	fw, err := flate.NewWriter(&w.buf, level)
+	if err != nil {
+		return nil, err
+	}
+	w.fw = fw
+
+	return w, nil
+}
+
+// Compress returns the compressed payload of a WebSocket "message",
+// ready to be sent as the data of a frame with the RSV1 bit set.
+// The trailing 0x00 0x00 0xff 0xff bytes are stripped.
+func (w *PerMessageDeflateWriter) Compress(message []byte) ([]byte, error) {
+	w.buf.Reset()
+	if !w.contextTakeover {
+		w.fw.Reset(&w.buf)
+	}
+
+	if _, err := w.fw.Write(message); err != nil {
+		return nil, err
+	}
+
+	if err := w.fw.Flush(); err != nil {
+		return nil, err
+	}
+
+	payload := bytes.TrimSuffix(w.buf.Bytes(), deflateTail)
+	return append([]byte(nil), payload...), nil
+}
+
+// PerMessageDeflateReader decompresses WebSocket messages following
+// the permessage-deflate extension of RFC 7692.
+// It is not safe for concurrent use.
+// It accepts payloads compressed with any window size.
+type PerMessageDeflateReader struct {
+	fr              io.ReadCloser
+	contextTakeover bool
+	maxMessageSize  int
+	// The last decompressed data, up to the window size,
+	// used as the dictionary of the next message on context takeover.
+	window []byte
+}
+
+// NewPerMessageDeflateReader returns a new permessage-deflate reader.
+// When "contextTakeover" is false, each message is decompressed independently,
+// as the "no_context_takeover" extension parameters require.
+// Optional "opts" set the maximum size of a decompressed message, see `WithMaxMessageSize`.
+func NewPerMessageDeflateReader(contextTakeover bool, opts ...Option) *PerMessageDeflateReader {
+	return &PerMessageDeflateReader{
+		fr:              flate.NewReader(nil),
+		contextTakeover: contextTakeover,
+		maxMessageSize:  newConfig(opts).maxMessageSize,
+	}
+}
+
+// Decompress returns the decompressed message of a WebSocket frame's "payload",
+// as it is received, without the trailing 0x00 0x00 0xff 0xff bytes.
+// It returns `ErrMessageTooLarge` if the decompressed message exceeds
+// the `WithMaxMessageSize` limit, the reader should not be used after that
+// on context takeover, as its window is not updated.
+func (r *PerMessageDeflateReader) Decompress(payload []byte) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail), bytes.NewReader(deflateFinalBlock))
+
+	if err := r.fr.(flate.Resetter).Reset(src, r.window); err != nil {
+		return nil, err
+	}
+
+	var fr io.Reader = r.fr
+	if r.maxMessageSize > 0 {
+		fr = io.LimitReader(fr, int64(r.maxMessageSize)+1)
+	}
+
+	message, err := io.ReadAll(fr)
+	if err != nil {
+		return nil, err
+	}
+	if r.maxMessageSize > 0 && len(message) > r.maxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	if r.contextTakeover {
+		r.window = append(r.window, message...)
+		if n := len(r.window); n > maxDeflateWindow {
+			r.window = append(r.window[:0], r.window[n-maxDeflateWindow:]...)
+		}
+	}
+
+	return message, nil
+}
@@ -0,0 +1,125 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// The "Hello" message examples of RFC 7692, section 7.2.3.
+var (
+	rfc7692Hello         = []byte{0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00}
+	rfc7692HelloTakeover = []byte{0xf2, 0x00, 0x11, 0x00, 0x00}
+	rfc7692HelloStored   = []byte{0x00, 0x05, 0x00, 0xfa, 0xff, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x00}
+)
+
+func TestPerMessageDeflateWriterRFC7692(t *testing.T) {
+	w, err := NewPerMessageDeflateWriter(DefaultCompression, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		payload, err := w.Compress([]byte("Hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(payload, rfc7692Hello) {
+			t.Fatalf("message %d: expected payload % x but got % x", i, rfc7692Hello, payload)
+		}
+	}
+}
+
+func TestPerMessageDeflateReaderRFC7692(t *testing.T) {
+	tests := []struct {
+		name            string
+		contextTakeover bool
+		payloads        [][]byte
+	}{
+		{"compressed", false, [][]byte{rfc7692Hello, rfc7692Hello}},
+		{"stored block", false, [][]byte{rfc7692HelloStored}},
+		{"context takeover", true, [][]byte{rfc7692Hello, rfc7692HelloTakeover}},
+	}
+
+	for _, tt := range tests {
+		r := NewPerMessageDeflateReader(tt.contextTakeover)
+		for i, payload := range tt.payloads {
+			message, err := r.Decompress(payload)
+			if err != nil {
+				t.Fatalf("%s: message %d: %v", tt.name, i, err)
+			}
+
+			if string(message) != "Hello" {
+				t.Fatalf("%s: message %d: expected %q but got %q", tt.name, i, "Hello", message)
+			}
+		}
+	}
+}
+
+func TestPerMessageDeflateContextTakeover(t *testing.T) {
+	message := []byte(`{"type":"update","channel":"prices","symbol":"BTC-USD","price":"64123.50","size":1}`)
+
+	for _, contextTakeover := range []bool{true, false} {
+		w, err := NewPerMessageDeflateWriter(DefaultCompression, contextTakeover)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewPerMessageDeflateReader(contextTakeover)
+
+		var sizes []int
+		for i := 0; i < 3; i++ {
+			payload, err := w.Compress(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes = append(sizes, len(payload))
+
+			got, err := r.Decompress(payload)
+			if err != nil {
+				t.Fatalf("context takeover=%v: message %d: %v", contextTakeover, i, err)
+			}
+			if !bytes.Equal(got, message) {
+				t.Fatalf("context takeover=%v: message %d: expected %q but got %q", contextTakeover, i, message, got)
+			}
+		}
+
+		if sizes[0] >= len(message) {
+			t.Fatalf("context takeover=%v: expected the message to be compressed but got %d bytes of %d", contextTakeover, sizes[0], len(message))
+		}
+
+		// Repeated messages reference the previous ones only on context takeover.
+		if smaller := sizes[1] < sizes[0]/4; smaller != contextTakeover {
+			t.Fatalf("context takeover=%v: unexpected message sizes %v", contextTakeover, sizes)
+		}
+	}
+}
+
+func TestPerMessageDeflateReaderMaxMessageSize(t *testing.T) {
+	w, err := NewPerMessageDeflateWriter(DefaultCompression, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A few KB which expand beyond the default 4MB limit.
+	bomb, err := w.Compress(make([]byte, defaultMaxMessageSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewPerMessageDeflateReader(false).Decompress(bomb); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("expected ErrMessageTooLarge but got %v", err)
+	}
+
+	if _, err = NewPerMessageDeflateReader(false, WithMaxMessageSize(4)).Decompress(rfc7692Hello); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("expected ErrMessageTooLarge but got %v", err)
+	}
+
+	message, err := NewPerMessageDeflateReader(false, WithMaxMessageSize(5)).Decompress(rfc7692Hello)
+	if err != nil || string(message) != "Hello" {
+		t.Fatalf("expected %q but got %q: %v", "Hello", message, err)
+	}
+
+	if message, err = NewPerMessageDeflateReader(false, WithMaxMessageSize(0)).Decompress(bomb); err != nil || len(message) != defaultMaxMessageSize+1 {
+		t.Fatalf("expected no limit but got %d bytes: %v", len(message), err)
+	}
+}